@@ -0,0 +1,227 @@
+// Decodes a capture of a serial link offline, with the framing and integrity checking of the protocol's
+// Gateway and Client, and prints every packet found.
+//
+// Usage:
+//
+//	bridgedump [flags] capture
+//
+// The capture is either the raw bytes one end of a link received, or a pcapng file written by a
+// Gateway's Capture. Both directions of a pcapng file are decoded and printed in the order they crossed the wire.
+// Bytes that don't make a valid packet are flagged as garbage, the first good packet after them as a resync,
+// and publish packets sent again as retransmissions.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/RoanBrand/SerialToTCPBridgeProtocol/protocol"
+)
+
+var (
+	framing   = flag.String("framing", "length", `Framing of the link: "length" or "cobs"`)
+	integrity = flag.String("integrity", "crc32", `Integrity check at the start of the capture: "crc32", "crc16", "crc32c" or "fec"`)
+	fixed     = flag.Bool("fixed-integrity", false, "Keep the integrity check, instead of following the one hello packets ask for")
+	preview   = flag.Int("preview", 16, "Payload bytes to show per packet")
+	timeout   = flag.Duration("byte-timeout", protocol.DefaultByteTimeout, "Longest the receiver waited for the next byte of a packet (pcapng only)")
+)
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: bridgedump [flags] capture")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	d := protocol.Decoder{FixedIntegrity: *fixed, ByteTimeout: *timeout}
+	switch *framing {
+	case "length":
+		d.Framing = protocol.FramingLength
+	case "cobs":
+		d.Framing = protocol.FramingCOBS
+	default:
+		log.Fatalf("Unknown framing %q", *framing)
+	}
+	if *timeout <= 0 {
+		log.Fatal("Byte timeout must be positive")
+	}
+	checks := map[string]protocol.Integrity{
+		"crc32":  protocol.IntegrityCRC32,
+		"crc16":  protocol.IntegrityCRC16,
+		"crc32c": protocol.IntegrityCRC32C,
+		"fec":    protocol.IntegrityFEC,
+	}
+	var ok bool
+	if d.Integrity, ok = checks[strings.ToLower(*integrity)]; !ok {
+		log.Fatalf("Unknown integrity check %q", *integrity)
+	}
+
+	data, err := os.ReadFile(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	var entries []entry
+	if protocol.IsCapture(data) {
+		received, sent, err := protocol.ReadCapture(bytes.NewReader(data))
+		if err != nil {
+			log.Fatalf("Reading pcapng: %v", err)
+		}
+		entries = decodeLink(d, received, sent)
+	} else {
+		entries = decode(d, []protocol.Chunk{{Data: data}})
+	}
+
+	var s summary
+	for _, e := range entries {
+		s.add(e)
+		fmt.Println(e.format(*preview))
+	}
+	fmt.Println(s)
+}
+
+// Decoded packet, with what it says about the link.
+type entry struct {
+	protocol.DecodedPacket
+	direction      string // "RX" or "TX" for pcapng captures.
+	resync         bool   // First good packet after garbage.
+	retransmission bool   // Same publish packet as the last one on its stream.
+}
+
+// Decode what one end of a link received, and flag resyncs and retransmissions.
+func decode(d protocol.Decoder, chunks []protocol.Chunk) (entries []entry) {
+	var f flagger
+	d.Decode(chunks, func(p protocol.DecodedPacket) {
+		entries = append(entries, f.flag(p, ""))
+	})
+	return entries
+}
+
+// Decode both directions of a link, in the order they crossed the wire, and flag resyncs and retransmissions.
+// Each direction switches to the integrity check a hello in either grants, like the ends do.
+func decodeLink(d protocol.Decoder, received, sent []protocol.Chunk) (entries []entry) {
+	var rx, tx flagger
+	d.DecodeLink(received, sent, func(isSent bool, p protocol.DecodedPacket) {
+		if isSent {
+			entries = append(entries, tx.flag(p, "TX"))
+		} else {
+			entries = append(entries, rx.flag(p, "RX"))
+		}
+	})
+	return entries
+}
+
+// Flags resyncs and retransmissions in one direction of a link.
+type flagger struct {
+	garbage     bool
+	lastPublish map[byte][]byte // by channel
+}
+
+func (f *flagger) flag(p protocol.DecodedPacket, direction string) entry {
+	e := entry{DecodedPacket: p, direction: direction}
+	if p.Result != protocol.DecodeOK {
+		f.garbage = true
+		return e
+	}
+	e.resync, f.garbage = f.garbage, false
+	if p.Name == "publish" {
+		if f.lastPublish == nil {
+			f.lastPublish = make(map[byte][]byte)
+		}
+		e.retransmission = bytes.Equal(p.Raw, f.lastPublish[p.Channel])
+		f.lastPublish[p.Channel] = p.Raw
+	}
+	return e
+}
+
+func (e entry) format(previewLen int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%8d", e.Offset)
+	if !e.Time.IsZero() {
+		b.WriteString(e.Time.Format("  15:04:05.000000"))
+	}
+	if e.direction != "" {
+		b.WriteString("  " + e.direction)
+	}
+
+	if e.Result != protocol.DecodeOK {
+		fmt.Fprintf(&b, "  garbage: %d bytes, %v", len(e.Raw), e.Result)
+		if e.Name != "" {
+			fmt.Fprintf(&b, " (as %s length=%d check=%v)", e.Name, e.Length, e.Check)
+		}
+		b.WriteString("  " + previewBytes(e.Raw, previewLen))
+		return b.String()
+	}
+
+	fmt.Fprintf(&b, "  %-11s", e.Name)
+	for i := 2; i+1 < len(e.Attrs); i += 2 { // after the command
+		if key := e.Attrs[i]; key != "ok" {
+			fmt.Fprintf(&b, " %v=%v", key, e.Attrs[i+1])
+		}
+	}
+	b.WriteString(" ok")
+	if e.resync {
+		b.WriteString("  [resync]")
+	}
+	if e.retransmission {
+		b.WriteString("  [retransmission]")
+	}
+	if len(e.Payload) > 0 {
+		b.WriteString("  " + previewBytes(e.Payload, previewLen))
+	}
+	return b.String()
+}
+
+// First n bytes in hex and as text.
+func previewBytes(data []byte, n int) string {
+	more := ""
+	if len(data) > n {
+		data, more = data[:n], "…"
+	}
+	text := []byte(string(data))
+	for i, c := range text {
+		if c < ' ' || c > '~' {
+			text[i] = '.'
+		}
+	}
+	return fmt.Sprintf("% x%s  %q%s", data, more, text, more)
+}
+
+type summary struct {
+	packets, bad, timeouts, truncated, garbageBytes, resyncs, retransmissions int
+}
+
+func (s *summary) add(e entry) {
+	switch e.Result {
+	case protocol.DecodeOK:
+		s.packets++
+	case protocol.DecodeBadCheck:
+		s.bad++
+	case protocol.DecodeTimeout:
+		s.timeouts++
+	default:
+		s.truncated++
+	}
+	if e.Result != protocol.DecodeOK {
+		s.garbageBytes += len(e.Raw)
+	}
+	if e.resync {
+		s.resyncs++
+	}
+	if e.retransmission {
+		s.retransmissions++
+	}
+}
+
+func (s summary) String() string {
+	return fmt.Sprintf("%d packets, %d failed integrity check, %d timed out, %d truncated, %d garbage bytes, %d resyncs, %d retransmissions",
+		s.packets, s.bad, s.timeouts, s.truncated, s.garbageBytes, s.resyncs, s.retransmissions)
+}
@@ -4,10 +4,11 @@
 package comwrapper
 
 import (
+	"context"
 	"github.com/RoanBrand/SerialToTCPBridgeProtocol/protocol"
 	"github.com/tarm/serial"
-	"log"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -25,6 +26,11 @@ func Dial(portName string, baudRate int, address string) (net.Conn, error) {
 type comGateway struct {
 	protocol.Gateway
 	ComConfig *serial.Config
+	Device    *DeviceMatch // If set, the port of this USB device is served, and ComConfig.Name follows it.
+	Metrics   *Metrics     // If set, the Gateway's statistics are included while it serves, labelled with its Name.
+
+	log      protocol.Logger // Logger with the Gateway's name and port attached.
+	portLock sync.Mutex      // Guards changes to ComConfig.Name while serving, as Metrics reads it.
 }
 
 func NewComPortGateway(portName string, baudRate int) *comGateway {
@@ -34,28 +40,87 @@ func NewComPortGateway(portName string, baudRate int) *comGateway {
 }
 
 // Start Gateway on a COM port interface to service single protocol Client.
-func (com *comGateway) ListenAndServe() {
+// Runs until ctx is done, then disconnects the Client, closes the COM port and returns ctx.Err().
+// The Gateway's log messages get a "port" attribute.
+// Invalid Timings are returned as an error straight away.
+func (com *comGateway) ListenAndServe(ctx context.Context) error {
+	if err := com.Timings.Validate(); err != nil {
+		return err
+	}
+	base := com.Logger
+	defer func() { com.Logger = base }()
+	if base == nil {
+		base = protocol.StdLogger{Verbose: com.Trace}
+	}
+	com.useLogger(base)
+	timings := com.Timings.WithDefaults()
+	if com.Metrics != nil {
+		com.Metrics.add(com)
+		defer com.Metrics.remove(com)
+	}
 	for {
 		var port *serial.Port
 		firstTryDone := false
 		// Attempt to open the COM port on the system.
 		for {
-			p, err := serial.OpenPort(com.ComConfig)
+			p, err := com.open()
 			if err == nil {
 				port = p
 				break
 			}
 			if !firstTryDone {
-				log.Printf("Gateway @ '%s': Error opening COM port -> %v\nRetrying every 5s..\n", com.ComConfig.Name, err)
+				com.log.Error("Error opening COM port. Retrying", "every", timings.OpenRetry, "error", err)
 				firstTryDone = true
 			}
-			time.Sleep(time.Second * 5)
+			if !sleep(ctx, timings.OpenRetry) {
+				return ctx.Err()
+			}
 		}
 
 		// Open success.
-		log.Printf("Gateway @ '%s': Started service.\n", com.ComConfig.Name)
-		com.Listen(port)
-		log.Printf("Gateway @ '%s': Fatal error. Closing COM port\n", com.ComConfig.Name)
-		time.Sleep(time.Second * 2)
+		com.useLogger(base)
+		com.log.Info("Started service")
+		if err := com.Serve(ctx, port); ctx.Err() != nil {
+			com.log.Info("Stopped service")
+			return err
+		}
+		com.log.Error("Fatal error. Closing COM port")
+		if !sleep(ctx, timings.RestartDelay) {
+			return ctx.Err()
+		}
+	}
+}
+
+// Log through base with the port attached, and have the Gateway do the same.
+func (com *comGateway) useLogger(base protocol.Logger) {
+	com.Logger = attrLogger{base, []any{"port", com.ComConfig.Name}}
+	com.log = com.Logger
+	if com.Name != "" {
+		com.log = attrLogger{com.Logger, []any{"gateway", com.Name}}
+	}
+}
+
+// Name of the COM port served.
+func (com *comGateway) portName() string {
+	com.portLock.Lock()
+	defer com.portLock.Unlock()
+	return com.ComConfig.Name
+}
+
+func (com *comGateway) setPortName(name string) {
+	com.portLock.Lock()
+	com.ComConfig.Name = name
+	com.portLock.Unlock()
+}
+
+// Wait for d, unless ctx is done first. false if it is.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }
@@ -0,0 +1,139 @@
+package comwrapper
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/tarm/serial"
+)
+
+// Selects the serial port of a USB device, whatever name the system gave it.
+// Empty fields match any device. At least one must be set.
+type DeviceMatch struct {
+	VendorID     string // USB vendor ID in hex, like "2341".
+	ProductID    string // USB product ID in hex, like "0043".
+	SerialNumber string // USB serial number string.
+
+	// Linux only: sysfs path of the device, or of a hub port it is plugged into,
+	// like "/sys/devices/pci0000:00/0000:00:14.0/usb1/1-2". Pins a gateway to a physical port.
+	SysfsPath string
+}
+
+// USB device a serial port belongs to.
+type usbDevice struct {
+	vendorID, productID, serialNumber, path string
+}
+
+func (m DeviceMatch) Validate() error {
+	if m == (DeviceMatch{}) {
+		return errors.New("Device match needs a vendor ID, product ID, serial number or sysfs path")
+	}
+	return nil
+}
+
+func (m DeviceMatch) String() string {
+	var parts []string
+	if m.VendorID != "" || m.ProductID != "" {
+		parts = append(parts, "USB "+orAny(m.VendorID)+":"+orAny(m.ProductID))
+	}
+	if m.SerialNumber != "" {
+		parts = append(parts, "serial "+m.SerialNumber)
+	}
+	if m.SysfsPath != "" {
+		parts = append(parts, "at "+m.SysfsPath)
+	}
+	return strings.Join(parts, " ")
+}
+
+func orAny(id string) string {
+	if id == "" {
+		return "*"
+	}
+	return id
+}
+
+func (m DeviceMatch) matches(d usbDevice) bool {
+	if m.VendorID != "" && !strings.EqualFold(m.VendorID, d.vendorID) {
+		return false
+	}
+	if m.ProductID != "" && !strings.EqualFold(m.ProductID, d.productID) {
+		return false
+	}
+	if m.SerialNumber != "" && m.SerialNumber != d.serialNumber {
+		return false
+	}
+	if m.SysfsPath != "" {
+		p := strings.TrimSuffix(m.SysfsPath, "/")
+		if d.path != p && !strings.HasPrefix(d.path, p+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+// Name of the serial port the device is on now.
+// Fails if no port matches, or several do, as we couldn't tell which board is the right one.
+func (m DeviceMatch) find() (string, error) {
+	devices, err := usbDevices()
+	if err != nil {
+		return "", err
+	}
+	var found []string
+	for name, d := range devices {
+		if m.matches(d) {
+			found = append(found, name)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", errors.New("No serial port for device " + m.String())
+	case 1:
+		return found[0], nil
+	}
+	sort.Strings(found)
+	return "", errors.New("Several serial ports for device " + m.String() + ": " + strings.Join(found, ", "))
+}
+
+// A Protocol Gateway listening on the serial port of a USB device.
+// The port is looked up every time it is opened, so the Gateway follows the device when it gets another name.
+func NewUSBDeviceGateway(m DeviceMatch, baudRate int) *comGateway {
+	com := NewComPortGateway(m.String(), baudRate)
+	com.Device = &m
+	return com
+}
+
+// Open the COM port, looking up the device's port first if the Gateway serves a USB device.
+func (com *comGateway) open() (*serial.Port, error) {
+	if com.Device != nil {
+		name, err := com.Device.find()
+		if err != nil {
+			return nil, err
+		}
+		if name != com.ComConfig.Name {
+			com.log.Info("Device found on another port", "device", com.Device, "new port", name)
+			com.setPortName(name)
+		}
+	}
+	return serial.OpenPort(com.ComConfig)
+}
+
+// Ports of devices that match any of ms, among those found.
+func devicePorts(ms []DeviceMatch) map[string]bool {
+	ports := make(map[string]bool)
+	if len(ms) == 0 {
+		return ports
+	}
+	devices, err := usbDevices()
+	if err != nil {
+		return ports
+	}
+	for name, d := range devices {
+		for _, m := range ms {
+			if m.matches(d) {
+				ports[name] = true
+			}
+		}
+	}
+	return ports
+}
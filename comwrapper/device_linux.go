@@ -0,0 +1,40 @@
+package comwrapper
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// USB devices of the serial ports on the system, by port name, from sysfs.
+func usbDevices() (map[string]usbDevice, error) {
+	entries, err := os.ReadDir("/sys/class/tty")
+	if err != nil {
+		return nil, err
+	}
+	devices := make(map[string]usbDevice)
+	for _, e := range entries {
+		dir, err := filepath.EvalSymlinks(filepath.Join("/sys/class/tty", e.Name(), "device"))
+		if err != nil {
+			continue
+		}
+		// The tty hangs off a USB interface, or a USB serial converter on one.
+		// The USB device is the first parent with a vendor ID.
+		for ; strings.HasPrefix(dir, "/sys/devices/"); dir = filepath.Dir(dir) {
+			vendorID, err := os.ReadFile(filepath.Join(dir, "idVendor"))
+			if err != nil {
+				continue
+			}
+			productID, _ := os.ReadFile(filepath.Join(dir, "idProduct"))
+			serialNumber, _ := os.ReadFile(filepath.Join(dir, "serial"))
+			devices["/dev/"+e.Name()] = usbDevice{
+				vendorID:     strings.TrimSpace(string(vendorID)),
+				productID:    strings.TrimSpace(string(productID)),
+				serialNumber: strings.TrimSpace(string(serialNumber)),
+				path:         dir,
+			}
+			break
+		}
+	}
+	return devices, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !windows
+
+package comwrapper
+
+import "errors"
+
+func usbDevices() (map[string]usbDevice, error) {
+	return nil, errors.New("Finding serial ports by USB device is not supported on this system")
+}
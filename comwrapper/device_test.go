@@ -0,0 +1,48 @@
+package comwrapper
+
+import "testing"
+
+func TestDeviceMatch(t *testing.T) {
+	uno := usbDevice{vendorID: "2341", productID: "0043", serialNumber: "8573531303635161C1B1", path: "/sys/devices/pci0000:00/0000:00:14.0/usb1/1-2"}
+	ftdi := usbDevice{vendorID: "0403", productID: "6001", serialNumber: "A6008isP", path: "/sys/devices/pci0000:00/0000:00:14.0/usb1/1-3/1-3.1"}
+	tests := []struct {
+		m    DeviceMatch
+		d    usbDevice
+		want bool
+	}{
+		{DeviceMatch{VendorID: "2341"}, uno, true},
+		{DeviceMatch{VendorID: "2341"}, ftdi, false},
+		{DeviceMatch{VendorID: "2341", ProductID: "0043"}, uno, true},
+		{DeviceMatch{VendorID: "2341", ProductID: "0042"}, uno, false},
+		{DeviceMatch{ProductID: "6001"}, ftdi, true},
+		{DeviceMatch{VendorID: "0403", ProductID: "6001", SerialNumber: "A6008isP"}, ftdi, true},
+		{DeviceMatch{VendorID: "0403", ProductID: "6001", SerialNumber: "A6008isQ"}, ftdi, false},
+
+		// IDs are hex, in whatever case the system reports them. Serial numbers are compared exactly.
+		{DeviceMatch{VendorID: "0403", ProductID: "6001"}, usbDevice{vendorID: "0403", productID: "6001"}, true},
+		{DeviceMatch{VendorID: "10c4", ProductID: "ea60"}, usbDevice{vendorID: "10C4", productID: "EA60"}, true},
+		{DeviceMatch{VendorID: "10C4", ProductID: "EA60"}, usbDevice{vendorID: "10c4", productID: "ea60"}, true},
+		{DeviceMatch{SerialNumber: "a6008isp"}, ftdi, false},
+
+		// Devices missing a field don't match on it.
+		{DeviceMatch{SerialNumber: "A6008isP"}, usbDevice{vendorID: "0403", productID: "6001"}, false},
+		{DeviceMatch{VendorID: "2341"}, usbDevice{}, false},
+		{DeviceMatch{SysfsPath: "/sys/devices/pci0000:00/0000:00:14.0/usb1/1-2"}, usbDevice{vendorID: "2341"}, false},
+
+		// Sysfs paths match the device, or any device plugged in below it.
+		{DeviceMatch{SysfsPath: "/sys/devices/pci0000:00/0000:00:14.0/usb1/1-2"}, uno, true},
+		{DeviceMatch{SysfsPath: "/sys/devices/pci0000:00/0000:00:14.0/usb1/1-2/"}, uno, true},
+		{DeviceMatch{SysfsPath: "/sys/devices/pci0000:00/0000:00:14.0/usb1/1-3"}, ftdi, true},
+		{DeviceMatch{SysfsPath: "/sys/devices/pci0000:00/0000:00:14.0/usb1/1-3"}, uno, false},
+		{DeviceMatch{SysfsPath: "/sys/devices/pci0000:00/0000:00:14.0/usb1/1-3.1"}, ftdi, false},
+	}
+	for _, test := range tests {
+		if got := test.m.matches(test.d); got != test.want {
+			t.Errorf("%v matches %+v = %v, want %v", test.m, test.d, got, test.want)
+		}
+	}
+
+	if err := (DeviceMatch{}).Validate(); err == nil {
+		t.Error("Expected an empty DeviceMatch to be invalid")
+	}
+}
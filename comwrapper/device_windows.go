@@ -0,0 +1,79 @@
+package comwrapper
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// USB devices of the serial ports on the system, by port name, from the registry's device trees:
+// Enum\USB\VID_xxxx&PID_xxxx\<instance>\Device Parameters has the port name of a serial device,
+// and so does Enum\FTDIBUS\VID_xxxx+PID_xxxx+<serial number><port letter>\<instance> for devices
+// on FTDI's own driver, which doesn't list them under Enum\USB.
+func usbDevices() (map[string]usbDevice, error) {
+	devices := make(map[string]usbDevice)
+	if err := enumDevices(devices, "USB", "&"); err != nil {
+		return nil, err
+	}
+	if err := enumDevices(devices, "FTDIBUS", "+"); err != nil && !errors.Is(err, registry.ErrNotExist) {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// Add the serial ports of the devices in one tree under Enum. Parts of device IDs are separated by sep.
+func enumDevices(devices map[string]usbDevice, tree, sep string) error {
+	ftdi := tree == "FTDIBUS"
+	root, err := registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Enum\`+tree, registry.ENUMERATE_SUB_KEYS)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	ids, err := root.ReadSubKeyNames(0)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		var d usbDevice
+		for _, part := range strings.Split(id, sep) {
+			if v, ok := strings.CutPrefix(part, "VID_"); ok {
+				d.vendorID = v
+			} else if v, ok := strings.CutPrefix(part, "PID_"); ok {
+				d.productID = v
+			} else if ftdi && len(part) > 1 {
+				d.serialNumber = part[:len(part)-1] // FTDIBUS adds the letter of the port on the device
+			}
+		}
+		if d.vendorID == "" {
+			continue
+		}
+		k, err := registry.OpenKey(root, id, registry.ENUMERATE_SUB_KEYS)
+		if err != nil {
+			continue
+		}
+		instances, _ := k.ReadSubKeyNames(0)
+		k.Close()
+		for _, instance := range instances {
+			params, err := registry.OpenKey(root, id+`\`+instance+`\Device Parameters`, registry.QUERY_VALUE)
+			if err != nil {
+				continue
+			}
+			port, _, err := params.GetStringValue("PortName")
+			params.Close()
+			if err != nil {
+				continue
+			}
+			if !ftdi {
+				d.serialNumber = ""
+				if !strings.Contains(instance, "&") { // generated instance IDs have these, serial numbers don't
+					d.serialNumber = instance
+				}
+			}
+			d.path = tree + `\` + id + `\` + instance
+			devices[port] = d
+		}
+	}
+	return nil
+}
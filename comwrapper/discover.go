@@ -0,0 +1,178 @@
+package comwrapper
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/RoanBrand/SerialToTCPBridgeProtocol/protocol"
+)
+
+// Serial ports served by Discovery when Discovery.Include is empty:
+// USB serial adapters and USB CDC devices like Arduinos on Linux and macOS, Raspberry Pi UARTs, and Windows COM ports.
+var DefaultInclude = []string{"/dev/ttyUSB*", "/dev/ttyACM*", "/dev/ttyAMA*", "/dev/tty.usb*", "COM*"}
+
+// How often Discovery looks for serial ports when Discovery.Interval is not set.
+const DefaultScanInterval = time.Second * 2
+
+// Serves a protocol Gateway on every serial port found on the system.
+// Ports are looked for periodically, so a Gateway is started for a device when it is plugged in,
+// and stopped when it is unplugged.
+type Discovery struct {
+	// Port names to serve, as path.Match patterns like "/dev/ttyUSB*" or "COM*".
+	// Empty means DefaultInclude.
+	Include []string
+
+	// Port names never to serve, even if included. For example ports served by a Gateway of their own.
+	Exclude []string
+
+	// USB devices never to serve, like those with a Gateway of their own.
+	ExcludeDevices []DeviceMatch
+
+	BaudRate int
+
+	// How often to look for serial ports. Zero means DefaultScanInterval.
+	Interval time.Duration
+
+	Name    string   // Name of the Gateways, in Metrics and log messages.
+	Metrics *Metrics // If set, statistics of the Gateways are included.
+
+	// Where Discovery and its Gateways log to. Nil means the standard log package.
+	Logger protocol.Logger
+
+	// Configures the Gateway of a newly found port, before it starts serving. Optional.
+	Configure func(portName string, g *protocol.Gateway)
+}
+
+// Check that the include and exclude patterns are valid.
+func (d *Discovery) Validate() error {
+	for _, pattern := range append(append([]string(nil), d.Include...), d.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.New("Invalid port pattern '" + pattern + "'")
+		}
+	}
+	for _, m := range d.ExcludeDevices {
+		if err := m.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether a port found on the system should be served.
+func (d *Discovery) matches(portName string) bool {
+	include := d.Include
+	if len(include) == 0 {
+		include = DefaultInclude
+	}
+	if !matchAny(include, portName) {
+		return false
+	}
+	return !matchAny(d.Exclude, portName)
+}
+
+func matchAny(patterns []string, portName string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, portName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// A Gateway serving a port found by Discovery.
+type discoveredGateway struct {
+	stop    context.CancelFunc
+	stopped chan struct{}
+	gone    bool // The port is gone, and the Gateway stopping.
+}
+
+func (d *Discovery) logger() protocol.Logger {
+	if d.Logger == nil {
+		return protocol.StdLogger{}
+	}
+	return d.Logger
+}
+
+// Look for serial ports and serve the ones that match, until ctx is done.
+// Then every Gateway is shut down, and ctx.Err() returned once they all have.
+func (d *Discovery) ListenAndServe(ctx context.Context) error {
+	interval := d.Interval
+	if interval <= 0 {
+		interval = DefaultScanInterval
+	}
+	gateways := make(map[string]*discoveredGateway)
+	defer func() {
+		for _, g := range gateways {
+			g.stop()
+		}
+		for _, g := range gateways {
+			<-g.stopped
+		}
+	}()
+	scanFailed := false
+	for {
+		ports, err := scanPorts()
+		if err != nil {
+			if !scanFailed {
+				d.logger().Error("Discovery: Error looking for serial ports", "error", err)
+				scanFailed = true
+			}
+		} else {
+			scanFailed = false
+			d.update(ctx, gateways, ports)
+		}
+		if !sleep(ctx, interval) {
+			return ctx.Err()
+		}
+	}
+}
+
+// Start Gateways for new ports, and stop those of ports that are gone.
+func (d *Discovery) update(ctx context.Context, gateways map[string]*discoveredGateway, ports []string) {
+	sort.Strings(ports)
+	excluded := devicePorts(d.ExcludeDevices)
+	found := make(map[string]bool, len(ports))
+	for _, name := range ports {
+		if !d.matches(name) || excluded[name] {
+			continue
+		}
+		found[name] = true
+		if g := gateways[name]; g != nil {
+			if !g.gone {
+				continue
+			}
+			<-g.stopped // back already. The old Gateway must let go of the port first
+		}
+		d.logger().Info("Discovery: Found serial port", "port", name)
+		com := NewComPortGateway(name, d.BaudRate)
+		com.Name, com.Metrics, com.Logger = d.Name, d.Metrics, d.Logger
+		if d.Configure != nil {
+			d.Configure(name, &com.Gateway)
+		}
+		gCtx, stop := context.WithCancel(ctx)
+		g := &discoveredGateway{stop: stop, stopped: make(chan struct{})}
+		gateways[name] = g
+		go func() {
+			defer close(g.stopped)
+			com.ListenAndServe(gCtx)
+		}()
+	}
+	// Gateways of ports that are gone are kept until they have stopped, to be waited for.
+	for name, g := range gateways {
+		if !found[name] && !g.gone {
+			d.logger().Info("Discovery: Serial port is gone", "port", name)
+			g.stop()
+			g.gone = true
+		}
+		if g.gone {
+			select {
+			case <-g.stopped:
+				delete(gateways, name)
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package comwrapper
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Serial ports on the system, from sysfs. Only ttys backed by a device are listed,
+// which leaves out virtual consoles and pseudo terminals.
+func scanPorts() ([]string, error) {
+	entries, err := os.ReadDir("/sys/class/tty")
+	if err != nil {
+		return nil, err
+	}
+	ports := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if _, err := os.Stat(filepath.Join("/sys/class/tty", e.Name(), "device")); err != nil {
+			continue
+		}
+		ports = append(ports, "/dev/"+e.Name())
+	}
+	return ports, nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux && !windows
+
+package comwrapper
+
+import "path/filepath"
+
+// Serial ports on the system, from the device nodes in /dev.
+func scanPorts() ([]string, error) {
+	var ports []string
+	for _, pattern := range []string{"/dev/tty*", "/dev/cu.*"} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, matches...)
+	}
+	return ports, nil
+}
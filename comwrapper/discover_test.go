@@ -0,0 +1,87 @@
+package comwrapper
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDiscoveryMatches(t *testing.T) {
+	tests := []struct {
+		include, exclude []string
+		port             string
+		want             bool
+	}{
+		{nil, nil, "/dev/ttyUSB0", true},
+		{nil, nil, "/dev/ttyACM1", true},
+		{nil, nil, "COM3", true},
+		{nil, nil, "/dev/ttyS0", false},
+		{nil, []string{"/dev/ttyUSB1"}, "/dev/ttyUSB1", false},
+		{nil, []string{"/dev/ttyUSB1"}, "/dev/ttyUSB0", true},
+		{[]string{"/dev/ttyS*"}, nil, "/dev/ttyS0", true},
+		{[]string{"/dev/ttyS*"}, nil, "/dev/ttyUSB0", false},
+		{[]string{"/dev/tty*"}, []string{"/dev/ttyS*"}, "/dev/ttyS0", false},
+		{[]string{"COM?"}, nil, "COM12", false},
+	}
+	for _, test := range tests {
+		d := Discovery{Include: test.include, Exclude: test.exclude}
+		if got := d.matches(test.port); got != test.want {
+			t.Errorf("Include %q, exclude %q: matches(%q) = %v, want %v", test.include, test.exclude, test.port, got, test.want)
+		}
+	}
+}
+
+// Gateways are started for ports that appear, and stopped for ports that are gone.
+// A port that comes back gets a new Gateway only once the old one has let go of it.
+func TestDiscoveryUpdate(t *testing.T) {
+	const port = "/nonexistent/ttyTEST1"
+	d := &Discovery{Include: []string{"/nonexistent/ttyTEST*"}, Exclude: []string{"/nonexistent/ttyTEST9"}, Logger: discardLogger{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	gateways := make(map[string]*discoveredGateway)
+	defer func() {
+		cancel()
+		for _, g := range gateways {
+			<-g.stopped
+		}
+	}()
+
+	d.update(ctx, gateways, []string{"/dev/ttyS0", "/nonexistent/ttyTEST9", port})
+	first := gateways[port]
+	if len(gateways) != 1 || first == nil || first.gone {
+		t.Fatalf("Expected a Gateway for %s only, got %v", port, gateways)
+	}
+	d.update(ctx, gateways, []string{port})
+	if gateways[port] != first {
+		t.Fatal("Gateway replaced while its port was still there")
+	}
+
+	// Unplugged and plugged back in before the next scan is done with the old Gateway.
+	d.update(ctx, gateways, nil)
+	if !first.gone {
+		t.Fatal("Expected the Gateway of a port that is gone to be stopping")
+	}
+	d.update(ctx, gateways, []string{port})
+	select {
+	case <-first.stopped:
+	default:
+		t.Fatal("New Gateway started before the old one stopped")
+	}
+	second := gateways[port]
+	if second == nil || second == first || second.gone {
+		t.Fatalf("Expected a new Gateway for %s, got %v", port, second)
+	}
+
+	// Unplugged for good, and forgotten once stopped.
+	d.update(ctx, gateways, nil)
+	<-second.stopped
+	d.update(ctx, gateways, nil)
+	if len(gateways) != 0 {
+		t.Fatalf("Expected no Gateways, got %v", gateways)
+	}
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Debug(msg string, args ...any) {}
+func (discardLogger) Info(msg string, args ...any)  {}
+func (discardLogger) Warn(msg string, args ...any)  {}
+func (discardLogger) Error(msg string, args ...any) {}
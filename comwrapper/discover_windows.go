@@ -0,0 +1,31 @@
+package comwrapper
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// Serial ports on the system, from the registry's device map.
+func scanPorts() ([]string, error) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, `HARDWARE\DEVICEMAP\SERIALCOMM`, registry.QUERY_VALUE)
+	if errors.Is(err, registry.ErrNotExist) {
+		return nil, nil // no serial ports at all
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer k.Close()
+
+	names, err := k.ReadValueNames(0)
+	if err != nil {
+		return nil, err
+	}
+	ports := make([]string, 0, len(names))
+	for _, name := range names {
+		if port, _, err := k.GetStringValue(name); err == nil {
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
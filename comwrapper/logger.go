@@ -0,0 +1,18 @@
+package comwrapper
+
+import "github.com/RoanBrand/SerialToTCPBridgeProtocol/protocol"
+
+// Logger adding attributes to every message.
+type attrLogger struct {
+	protocol.Logger
+	attrs []any
+}
+
+func (l attrLogger) with(args []any) []any {
+	return append(args[:len(args):len(args)], l.attrs...)
+}
+
+func (l attrLogger) Debug(msg string, args ...any) { l.Logger.Debug(msg, l.with(args)...) }
+func (l attrLogger) Info(msg string, args ...any)  { l.Logger.Info(msg, l.with(args)...) }
+func (l attrLogger) Warn(msg string, args ...any)  { l.Logger.Warn(msg, l.with(args)...) }
+func (l attrLogger) Error(msg string, args ...any) { l.Logger.Error(msg, l.with(args)...) }
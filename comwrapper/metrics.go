@@ -0,0 +1,94 @@
+package comwrapper
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/RoanBrand/SerialToTCPBridgeProtocol/protocol"
+)
+
+// Statistics of Gateways, served over HTTP in the Prometheus text format.
+// Gateways with Metrics set are included while they serve, labelled with their name and the port they are on.
+type Metrics struct {
+	lock     sync.Mutex
+	gateways map[*comGateway]bool
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{gateways: make(map[*comGateway]bool)}
+}
+
+func (m *Metrics) add(com *comGateway) {
+	m.lock.Lock()
+	m.gateways[com] = true
+	m.lock.Unlock()
+}
+
+func (m *Metrics) remove(com *comGateway) {
+	m.lock.Lock()
+	delete(m.gateways, com)
+	m.lock.Unlock()
+}
+
+var gatewayMetrics = []struct {
+	name, kind, help string
+	value            func(s *protocol.GatewayStats) uint64
+}{
+	{"serialbridge_frames_sent_total", "counter", "Packets written to the serial link.",
+		func(s *protocol.GatewayStats) uint64 { return s.FramesSent }},
+	{"serialbridge_frames_received_total", "counter", "Packets received that passed their integrity check.",
+		func(s *protocol.GatewayStats) uint64 { return s.FramesReceived }},
+	{"serialbridge_crc_failures_total", "counter", "Packets received that failed their integrity check.",
+		func(s *protocol.GatewayStats) uint64 { return s.IntegrityFailures }},
+	{"serialbridge_rx_timeouts_total", "counter", "Packets that stopped arriving halfway through.",
+		func(s *protocol.GatewayStats) uint64 { return s.RxTimeouts }},
+	{"serialbridge_retransmits_total", "counter", "Publish packets sent again for lack of an ack.",
+		func(s *protocol.GatewayStats) uint64 { return s.Retransmits }},
+	{"serialbridge_retries_exhausted_total", "counter", "Connections dropped because the client stopped acknowledging.",
+		func(s *protocol.GatewayStats) uint64 { return s.RetriesExhausted }},
+	{"serialbridge_upstream_bytes_sent_total", "counter", "Bytes written to upstream servers for the client.",
+		func(s *protocol.GatewayStats) uint64 { return s.BytesUp }},
+	{"serialbridge_upstream_bytes_received_total", "counter", "Bytes received from upstream servers for the client.",
+		func(s *protocol.GatewayStats) uint64 { return s.BytesDown }},
+	{"serialbridge_connect_attempts_total", "counter", "Connects from the client.",
+		func(s *protocol.GatewayStats) uint64 { return s.ConnectAttempts }},
+	{"serialbridge_connect_failures_total", "counter", "Connects refused, or to servers that couldn't be reached.",
+		func(s *protocol.GatewayStats) uint64 { return s.ConnectFailures }},
+	{"serialbridge_link_state", "gauge", "0 while the serial port isn't served, 1 while no connection is up, 2 while connected.",
+		func(s *protocol.GatewayStats) uint64 { return uint64(s.State) }},
+	{"serialbridge_streams", "gauge", "Connections open or opening on the link.",
+		func(s *protocol.GatewayStats) uint64 { return uint64(s.Streams) }},
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	type gatewayStats struct {
+		labels string
+		stats  protocol.GatewayStats
+	}
+	m.lock.Lock()
+	all := make([]gatewayStats, 0, len(m.gateways))
+	for com := range m.gateways {
+		// The port of a USB device's Gateway changes when the device gets another name.
+		all = append(all, gatewayStats{
+			labels: fmt.Sprintf(`{gateway="%s",port="%s"}`, labelEscaper.Replace(com.Name), labelEscaper.Replace(com.portName())),
+			stats:  com.Stats(),
+		})
+	}
+	m.lock.Unlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].labels < all[j].labels })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	var b strings.Builder
+	for _, metric := range gatewayMetrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for i := range all {
+			fmt.Fprintf(&b, "%s%s %d\n", metric.name, all[i].labels, metric.value(&all[i].stats))
+		}
+	}
+	w.Write([]byte(b.String()))
+}
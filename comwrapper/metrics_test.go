@@ -0,0 +1,33 @@
+package comwrapper
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Gateways are labelled with the port they are on when the metrics are read, which for a USB device can change.
+func TestMetricsPortLabel(t *testing.T) {
+	m := NewMetrics()
+	com := NewUSBDeviceGateway(DeviceMatch{VendorID: "2341", ProductID: "0043"}, 115200)
+	com.Name = "board"
+	m.add(com)
+
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w.Body.String()
+	}
+	if body := scrape(); !strings.Contains(body, `serialbridge_streams{gateway="board",port="USB 2341:0043"} 0`) {
+		t.Fatalf("Expected the device as the port before it is found, got:\n%s", body)
+	}
+	com.setPortName("/dev/ttyACM1")
+	if body := scrape(); !strings.Contains(body, `serialbridge_streams{gateway="board",port="/dev/ttyACM1"} 0`) {
+		t.Fatalf("Expected the port the device was found on, got:\n%s", body)
+	}
+
+	m.remove(com)
+	if body := scrape(); strings.Contains(body, `gateway="board"`) {
+		t.Fatalf("Expected the Gateway gone, got:\n%s", body)
+	}
+}
@@ -0,0 +1,81 @@
+package comwrapper
+
+import (
+	"context"
+
+	"github.com/RoanBrand/SerialToTCPBridgeProtocol/protocol"
+	"github.com/tarm/serial"
+)
+
+// A protocol Tap between two COM ports, one wired to the Client and one to the Gateway.
+type comTap struct {
+	protocol.Tap
+	ConfigA, ConfigB *serial.Config
+	Name             string // If set, log messages get a "tap" attribute.
+}
+
+func NewComPortTap(portA, portB string, baudRate int) *comTap {
+	return &comTap{
+		ConfigA: &serial.Config{Name: portA, Baud: baudRate},
+		ConfigB: &serial.Config{Name: portB, Baud: baudRate},
+	}
+}
+
+// Relay and decode the link between the two COM ports, reopening them if either fails.
+// Runs until ctx is done, then closes the COM ports and returns ctx.Err().
+// Directions are named after the ports, unless NameA and NameB are set.
+// Invalid Timings are returned as an error straight away.
+func (com *comTap) ListenAndServe(ctx context.Context) error {
+	if err := com.Timings.Validate(); err != nil {
+		return err
+	}
+	base := com.Logger
+	defer func() { com.Logger = base }()
+	if base == nil {
+		base = protocol.StdLogger{}
+	}
+	com.Logger = base
+	if com.Name != "" {
+		com.Logger = attrLogger{base, []any{"tap", com.Name}}
+	}
+	if com.NameA == "" {
+		com.NameA = com.ConfigA.Name
+	}
+	if com.NameB == "" {
+		com.NameB = com.ConfigB.Name
+	}
+	timings := com.Timings.WithDefaults()
+	for {
+		var a, b *serial.Port
+		firstTryDone := false
+		// Attempt to open both COM ports on the system.
+		for {
+			var err error
+			if a, err = serial.OpenPort(com.ConfigA); err == nil {
+				if b, err = serial.OpenPort(com.ConfigB); err == nil {
+					break
+				}
+				a.Close()
+			}
+			if !firstTryDone {
+				com.Logger.Error("Error opening COM port. Retrying", "every", timings.OpenRetry, "error", err)
+				firstTryDone = true
+			}
+			if !sleep(ctx, timings.OpenRetry) {
+				return ctx.Err()
+			}
+		}
+
+		// Open success.
+		com.Logger.Info("Started tap", "a", com.ConfigA.Name, "b", com.ConfigB.Name)
+		err := com.Serve(ctx, a, b)
+		if ctx.Err() != nil {
+			com.Logger.Info("Stopped tap")
+			return err
+		}
+		com.Logger.Error("Fatal error. Closing COM ports", "error", err)
+		if !sleep(ctx, timings.RestartDelay) {
+			return ctx.Err()
+		}
+	}
+}
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"path"
+	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/RoanBrand/SerialToTCPBridgeProtocol/comwrapper"
+	"github.com/RoanBrand/SerialToTCPBridgeProtocol/protocol"
 )
 
 func main() {
@@ -15,20 +25,81 @@ func main() {
 	if err != nil {
 		log.Fatalf(`%v (You must have a valid "config.json" next to the executable)`, err)
 	}
-	if len(c.Gateways) == 0 {
-		log.Fatal("No gateways configured in the config. Exiting.")
+	if len(c.Gateways) == 0 && len(c.Taps) == 0 {
+		log.Fatal("No gateways or taps configured in the config. Exiting.")
+	}
+
+	// Ports with a gateway of their own are left out of discovery.
+	var named []string
+	var devices []comwrapper.DeviceMatch
+	for _, v := range c.Gateways {
+		if v.Device != nil {
+			devices = append(devices, v.Device.match())
+		} else if v.Discover == nil {
+			named = append(named, v.COMPortName)
+		}
+	}
+
+	// Shut gateways down cleanly on Ctrl+C or from the service manager.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var metrics *comwrapper.Metrics
+	if c.MetricsAddress != "" {
+		metrics = comwrapper.NewMetrics()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		srv := &http.Server{Addr: c.MetricsAddress, Handler: mux}
+		go func() {
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				log.Printf("Metrics: %v\n", err)
+			}
+		}()
+		defer srv.Close()
 	}
 
 	w := sync.WaitGroup{}
 	for _, v := range c.Gateways {
 		w.Add(1)
 		go func(v gatewayConfig) {
-			com := comwrapper.NewComPortGateway(v.COMPortName, v.COMBaudRate)
-			com.ListenAndServe()
+			if v.Discover != nil {
+				d := comwrapper.Discovery{
+					Include:        v.Discover.Include,
+					Exclude:        append(v.Discover.Exclude, named...),
+					ExcludeDevices: devices,
+					BaudRate:       v.COMBaudRate,
+					Name:           v.GatewayName,
+					Metrics:        metrics,
+					Configure:      func(portName string, g *protocol.Gateway) { v.configure(g, portName) },
+				}
+				d.ListenAndServe(ctx)
+			} else if v.Device != nil {
+				com := comwrapper.NewUSBDeviceGateway(v.Device.match(), v.COMBaudRate)
+				com.Name, com.Metrics = v.GatewayName, metrics
+				v.configure(&com.Gateway, "")
+				com.ListenAndServe(ctx)
+			} else {
+				com := comwrapper.NewComPortGateway(v.COMPortName, v.COMBaudRate)
+				com.Name, com.Metrics = v.GatewayName, metrics
+				v.configure(&com.Gateway, "")
+				com.ListenAndServe(ctx)
+			}
+			w.Done()
+		}(v)
+	}
+	for _, v := range c.Taps {
+		w.Add(1)
+		go func(v tapConfig) {
+			tap := comwrapper.NewComPortTap(v.PortA, v.PortB, v.BaudRate)
+			tap.Name = v.Name
+			tap.Framing, tap.Integrity, tap.FixedIntegrity = v.framing, v.integrity, v.FixedIntegrity
+			tap.Timings = v.timings
+			tap.ListenAndServe(ctx)
 			w.Done()
 		}(v)
 	}
 	w.Wait()
+	log.Println("All gateways stopped.")
 }
 
 // Configuration by json file.
@@ -36,10 +107,165 @@ type gatewayConfig struct {
 	GatewayName string `json:"gateway name"`
 	COMPortName string `json:"comport name"`
 	COMBaudRate int    `json:"baud rate"`
+	ListenPorts []int  `json:"listen ports"`
+
+	// Destinations the gateway's client may connect to. Absent allows all.
+	Policy *protocol.Policy `json:"policy"`
+
+	// Hex encoded pre-shared keys of the devices that may use the gateway, by device ID.
+	// Absent lets any client connect without authenticating.
+	AuthKeys map[string]string `json:"auth keys"`
+	authKeys map[string][]byte
+
+	// Only accept encrypted connections. Needs auth keys.
+	RequireEncryption bool `json:"require encryption"`
+
+	// Don't compress connections for clients that ask for it.
+	DisableCompression bool `json:"disable compression"`
+
+	// "length" (default) or "cobs". Must match the client's framing.
+	Framing string `json:"framing"`
+	framing protocol.Framing
+
+	// Serve every serial port found on the system that matches, instead of "comport name".
+	// Devices are served when plugged in, and let go when unplugged.
+	Discover *discoverConfig `json:"discover"`
+
+	// Log every packet sent and received, decoded, to debug the serial link.
+	Trace bool `json:"trace"`
+
+	// Record everything crossing the serial link to a pcapng file.
+	Capture *captureConfig `json:"capture"`
+
+	// Serve the serial port of this USB device, instead of "comport name".
+	// The port is looked up whenever it is opened, so the gateway follows the board when it gets another name.
+	Device *deviceConfig `json:"device"`
+
+	// Timeouts, retries and buffer sizes of the serial link, for links much slower or faster than 115200 baud.
+	Timings *timingsConfig `json:"timings"`
+	timings protocol.Timings
+}
+
+// Patterns of serial port names, like "/dev/ttyUSB*" or "COM*".
+type discoverConfig struct {
+	Include []string `json:"include"` // Absent means comwrapper.DefaultInclude.
+	Exclude []string `json:"exclude"`
+}
+
+// USB device identity, as in comwrapper.DeviceMatch. Absent fields match any device.
+type deviceConfig struct {
+	VendorID     string `json:"vendor id"`
+	ProductID    string `json:"product id"`
+	SerialNumber string `json:"serial number"`
+	SysfsPath    string `json:"sysfs path"`
+}
+
+// As in protocol.Timings. Durations are like "250ms". Absent fields take the defaults.
+type timingsConfig struct {
+	ByteTimeout    string `json:"byte timeout"`
+	MaxRxErrors    int    `json:"max rx errors"`
+	AckTimeout     string `json:"ack timeout"`
+	MaxRetries     int    `json:"max retries"`
+	ConnackTimeout string `json:"connack timeout"`
+	RxBufferSize   int    `json:"rx buffer size"`
+	TxQueueSize    int    `json:"tx queue size"`
+	OpenRetry      string `json:"open retry"`
+	RestartDelay   string `json:"restart delay"`
+}
+
+// Parse and validate the timings.
+func (c *timingsConfig) parse() (t protocol.Timings, err error) {
+	if c == nil {
+		return t, nil
+	}
+	t = protocol.Timings{MaxRxErrors: c.MaxRxErrors, MaxRetries: c.MaxRetries, RxBufferSize: c.RxBufferSize, TxQueueSize: c.TxQueueSize}
+	for _, d := range []struct {
+		name  string
+		value string
+		to    *time.Duration
+	}{
+		{"byte timeout", c.ByteTimeout, &t.ByteTimeout},
+		{"ack timeout", c.AckTimeout, &t.AckTimeout},
+		{"connack timeout", c.ConnackTimeout, &t.ConnackTimeout},
+		{"open retry", c.OpenRetry, &t.OpenRetry},
+		{"restart delay", c.RestartDelay, &t.RestartDelay},
+	} {
+		if d.value == "" {
+			continue
+		}
+		if *d.to, err = time.ParseDuration(d.value); err != nil {
+			return t, fmt.Errorf("%s: %w", d.name, err)
+		}
+	}
+	return t, t.Validate()
+}
+
+// pcapng file to record the serial link to, and when to start a new one.
+type captureConfig struct {
+	File    string `json:"file"`
+	MaxSize int64  `json:"max size"` // Bytes. Absent means no limit.
+	MaxAge  string `json:"max age"`  // Like "1h". Absent means no limit.
+	maxAge  time.Duration
+}
+
+// Capture of a gateway. Discovered ports each get a file of their own, named after the port.
+func (c *captureConfig) capture(portName string) *protocol.Capture {
+	p := c.File
+	if portName != "" {
+		ext := filepath.Ext(p)
+		p = strings.TrimSuffix(p, ext) + "-" + filepath.Base(portName) + ext
+	}
+	return &protocol.Capture{Path: p, MaxSize: c.MaxSize, MaxAge: c.maxAge}
+}
+
+func (d *deviceConfig) match() comwrapper.DeviceMatch {
+	return comwrapper.DeviceMatch{VendorID: d.VendorID, ProductID: d.ProductID, SerialNumber: d.SerialNumber, SysfsPath: d.SysfsPath}
+}
+
+// Apply settings to a gateway. portName is set for gateways of discovered ports.
+func (v *gatewayConfig) configure(g *protocol.Gateway, portName string) {
+	g.ListenPorts = v.ListenPorts
+	g.Policy = v.Policy
+	g.AuthKeys = v.authKeys
+	g.RequireEncryption = v.RequireEncryption
+	g.DisableCompression = v.DisableCompression
+	g.Framing = v.framing
+	g.Trace = v.Trace
+	g.Timings = v.timings
+	if v.Capture != nil {
+		g.Capture = v.Capture.capture(portName)
+	}
+}
+
+// Passive tap between a client and a gateway of any make, on two serial ports of this machine.
+// Bytes are relayed between the ports, and the packets in both directions logged.
+type tapConfig struct {
+	Name     string `json:"name"`
+	PortA    string `json:"port a"`
+	PortB    string `json:"port b"`
+	BaudRate int    `json:"baud rate"`
+
+	// "length" (default) or "cobs", as used on the link.
+	Framing string `json:"framing"`
+	framing protocol.Framing
+
+	// "crc32" (default), "crc16", "crc32c" or "fec": integrity check at the start.
+	// Follows the one negotiated by hello packets, unless fixed.
+	Integrity      string `json:"integrity"`
+	FixedIntegrity bool   `json:"fixed integrity"`
+	integrity      protocol.Integrity
+
+	// As for gateways. Only "byte timeout", "rx buffer size", "open retry" and "restart delay" apply.
+	Timings *timingsConfig `json:"timings"`
+	timings protocol.Timings
 }
 
 type config struct {
 	Gateways []gatewayConfig `json:"gateways"`
+	Taps     []tapConfig     `json:"taps"`
+
+	// Address to serve Prometheus metrics of the gateways on, at /metrics, like ":9100". Absent turns it off.
+	MetricsAddress string `json:"metrics address"`
 }
 
 func loadConfig() (*config, error) {
@@ -64,9 +290,99 @@ func loadConfig() (*config, error) {
 	if err != nil {
 		return nil, err
 	}
+	for i := range configuration.Gateways {
+		g := &configuration.Gateways[i]
+		if g.Policy != nil {
+			if err = g.Policy.Validate(); err != nil {
+				return nil, fmt.Errorf("Gateway '%s' policy: %w", g.GatewayName, err)
+			}
+		}
+		ports := 0
+		for _, set := range []bool{g.COMPortName != "", g.Discover != nil, g.Device != nil} {
+			if set {
+				ports++
+			}
+		}
+		if ports != 1 {
+			return nil, fmt.Errorf("Gateway '%s' needs exactly one of comport name, discover or device", g.GatewayName)
+		}
+		if g.Device != nil {
+			if err = g.Device.match().Validate(); err != nil {
+				return nil, fmt.Errorf("Gateway '%s' device: %w", g.GatewayName, err)
+			}
+		}
+		if g.Discover != nil {
+			d := comwrapper.Discovery{Include: g.Discover.Include, Exclude: g.Discover.Exclude}
+			if err = d.Validate(); err != nil {
+				return nil, fmt.Errorf("Gateway '%s' discover: %w", g.GatewayName, err)
+			}
+		}
+		if g.Capture != nil {
+			if g.Capture.MaxAge != "" {
+				if g.Capture.maxAge, err = time.ParseDuration(g.Capture.MaxAge); err != nil {
+					return nil, fmt.Errorf("Gateway '%s' capture max age: %w", g.GatewayName, err)
+				}
+			}
+			if err = g.Capture.capture("").Validate(); err != nil {
+				return nil, fmt.Errorf("Gateway '%s' capture: %w", g.GatewayName, err)
+			}
+		}
+		var ok bool
+		if g.framing, ok = parseFraming(g.Framing); !ok {
+			return nil, fmt.Errorf("Gateway '%s' framing must be \"length\" or \"cobs\"", g.GatewayName)
+		}
+		if g.timings, err = g.Timings.parse(); err != nil {
+			return nil, fmt.Errorf("Gateway '%s' timings: %w", g.GatewayName, err)
+		}
+		if g.RequireEncryption && len(g.AuthKeys) == 0 {
+			return nil, fmt.Errorf("Gateway '%s' can't require encryption without auth keys", g.GatewayName)
+		}
+		if len(g.AuthKeys) != 0 {
+			g.authKeys = make(map[string][]byte, len(g.AuthKeys))
+		}
+		for id, key := range g.AuthKeys {
+			if g.authKeys[id], err = hex.DecodeString(key); err != nil || len(g.authKeys[id]) == 0 {
+				return nil, fmt.Errorf("Gateway '%s' auth key for '%s' must be hex encoded", g.GatewayName, id)
+			}
+		}
+	}
+	for i := range configuration.Taps {
+		t := &configuration.Taps[i]
+		if t.PortA == "" || t.PortB == "" {
+			return nil, fmt.Errorf("Tap '%s' needs port a and port b", t.Name)
+		}
+		var ok bool
+		if t.framing, ok = parseFraming(t.Framing); !ok {
+			return nil, fmt.Errorf("Tap '%s' framing must be \"length\" or \"cobs\"", t.Name)
+		}
+		if t.integrity, ok = integrities[strings.ToLower(t.Integrity)]; !ok {
+			return nil, fmt.Errorf("Tap '%s' integrity must be \"crc32\", \"crc16\", \"crc32c\" or \"fec\"", t.Name)
+		}
+		if t.timings, err = t.Timings.parse(); err != nil {
+			return nil, fmt.Errorf("Tap '%s' timings: %w", t.Name, err)
+		}
+	}
 	return &configuration, nil
 }
 
+func parseFraming(s string) (protocol.Framing, bool) {
+	switch s {
+	case "", "length":
+		return protocol.FramingLength, true
+	case "cobs":
+		return protocol.FramingCOBS, true
+	}
+	return 0, false
+}
+
+var integrities = map[string]protocol.Integrity{
+	"":       protocol.IntegrityCRC32,
+	"crc32":  protocol.IntegrityCRC32,
+	"crc16":  protocol.IntegrityCRC16,
+	"crc32c": protocol.IntegrityCRC32C,
+	"fec":    protocol.IntegrityFEC,
+}
+
 // fileExists checks if a file exists and is not a directory before we try using it to prevent further errors.
 func fileExists(filePath string) bool {
 	info, err := os.Stat(filePath)
@@ -5,6 +5,5 @@ go 1.20
 require (
 	github.com/RoanBrand/goBuffers v0.0.0-20180301183914-1aef5cc9c161
 	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07
+	golang.org/x/sys v0.6.0
 )
-
-require golang.org/x/sys v0.6.0 // indirect
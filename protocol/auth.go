@@ -0,0 +1,223 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Pre-shared key authentication of a Client to a Gateway.
+// When a Gateway has AuthKeys, it refuses connects until the Client on the link has authenticated:
+//
+//	Client:  auth [authHello][client nonce][device ID]
+//	Gateway: auth [authChallenge][gateway nonce]
+//	Client:  auth [authResponse][HMAC-SHA256(key, "client" | device ID | client nonce | gateway nonce)]
+//	Gateway: auth [authAccepted][HMAC-SHA256(key, "gateway" | device ID | client nonce | gateway nonce)]
+//	     or: auth [authRejected][reason]
+//
+// The Gateway picks a fresh nonce for every hello and accepts one response to it, so a recorded
+// response can't be replayed. The Client's nonce does the same for the Gateway's proof, which tells
+// the Client it is talking to a Gateway that knows its key.
+// Both sides then derive a session key for encrypted streams (see crypt.go).
+//
+// Connects on the authenticated link are bound to the session key, so that nobody else on the wire
+// can open connections through it. The Client appends a counter and a MAC to every connect payload:
+//
+//	[connect payload][counter][HMAC-SHA256(session key, "connect" | channel | command | counter | connect payload)]
+//
+// The counter is 4 bytes, little endian, and only the first connectMACSize bytes of the MAC are sent.
+// The Gateway refuses connects with a bad MAC, or with a counter not above the last one it accepted,
+// so recorded connects can't be replayed.
+const (
+	authHello = iota + 1
+	authChallenge
+	authResponse
+	authAccepted
+	authRejected
+)
+
+const authNonceSize = 16
+
+const connectMACSize = 16
+
+// Longest device ID a Client can authenticate with.
+const MaxDeviceIDLength = 64
+
+func authMAC(key []byte, label string, deviceID string, clientNonce, gatewayNonce []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	mac.Write([]byte(deviceID))
+	mac.Write(clientNonce)
+	mac.Write(gatewayNonce)
+	return mac.Sum(nil)
+}
+
+func connectMAC(sessionKey []byte, channel, command byte, counter, payload []byte) []byte {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte("connect"))
+	mac.Write([]byte{channel, command})
+	mac.Write(counter)
+	mac.Write(payload)
+	return mac.Sum(nil)[:connectMACSize]
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, authNonceSize)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// Handle an authentication step from the Client.
+func (g *Gateway) handleAuth(packet *Packet) {
+	if len(packet.payload) == 0 {
+		return
+	}
+	reject := func(reason DisconnectReason) {
+		g.authDevice, g.authChallenge = "", nil
+		g.send(Packet{command: auth, payload: []byte{authRejected, byte(reason)}})
+	}
+
+	switch packet.payload[0] {
+	case authHello:
+		g.authenticated = false
+		g.setSessionKey(nil)
+		if len(packet.payload) < 1+authNonceSize {
+			reject(ReasonProtocolError)
+			return
+		}
+		deviceID := string(packet.payload[1+authNonceSize:])
+		if _, ok := g.AuthKeys[deviceID]; !ok {
+			g.logger.warn("Authentication by unknown device refused", "device", deviceID)
+			reject(ReasonAuthFailed)
+			return
+		}
+		nonce, err := newNonce()
+		if err != nil {
+			g.logger.error("Error generating authentication challenge", "error", err)
+			reject(ReasonNoResources)
+			return
+		}
+		g.authDevice = deviceID
+		g.authClientNonce = append([]byte(nil), packet.payload[1:1+authNonceSize]...)
+		g.authChallenge = nonce
+		g.send(Packet{command: auth, payload: append([]byte{authChallenge}, nonce...)})
+	case authResponse:
+		if g.authChallenge == nil {
+			reject(ReasonProtocolError)
+			return
+		}
+		key := g.AuthKeys[g.authDevice]
+		want := authMAC(key, "client", g.authDevice, g.authClientNonce, g.authChallenge)
+		if !hmac.Equal(packet.payload[1:], want) {
+			g.logger.warn("Authentication failed", "device", g.authDevice)
+			reject(ReasonAuthFailed)
+			return
+		}
+		proof := authMAC(key, "gateway", g.authDevice, g.authClientNonce, g.authChallenge)
+		g.setSessionKey(authMAC(key, "session", g.authDevice, g.authClientNonce, g.authChallenge))
+		g.authChallenge = nil // one response per challenge
+		g.authenticated = true
+		g.connectCounter = 0
+		g.logger.info("Device authenticated", "device", g.authDevice)
+		g.send(Packet{command: auth, payload: append([]byte{authAccepted}, proof...)})
+	}
+}
+
+func (g *Gateway) setSessionKey(key []byte) {
+	g.streamsLock.Lock()
+	g.sessionKey = key
+	g.streamsLock.Unlock()
+}
+
+// Check the counter and MAC of a connect on the authenticated link.
+// Returns the connect payload without them, or false if the connect must be refused.
+func (g *Gateway) verifyConnect(p *Packet) ([]byte, bool) {
+	n := len(p.payload) - 4 - connectMACSize
+	if n < 0 {
+		return nil, false
+	}
+	payload, counter, mac := p.payload[:n], p.payload[n:n+4], p.payload[n+4:]
+	if !hmac.Equal(mac, connectMAC(g.sessionKey, p.channel, p.command, counter, payload)) {
+		return nil, false
+	}
+	if c := binary.LittleEndian.Uint32(counter); c > g.connectCounter {
+		g.connectCounter = c
+		return payload, true
+	}
+	return nil, false
+}
+
+// Append the counter and MAC binding a connect to the session.
+func (l *Link) signConnect(channel, command byte, payload []byte) []byte {
+	l.connectCounter++
+	counter := binary.LittleEndian.AppendUint32(nil, l.connectCounter)
+	mac := connectMAC(l.sessionKey, channel, command, counter, payload)
+	return append(append(payload[:len(payload):len(payload)], counter...), mac...)
+}
+
+// Authenticate the link to the Gateway with the Dialer's device ID and key.
+func (l *Link) authenticate() error {
+	deviceID, key := l.dialer.DeviceID, l.dialer.Key
+	timeout := l.dialer.Timeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	expired := time.After(timeout)
+	next := func() (Packet, error) {
+		select {
+		case p := <-l.authEvent:
+			if p.payload[0] == authRejected {
+				if len(p.payload) > 1 {
+					return p, DisconnectReason(p.payload[1])
+				}
+				return p, ReasonAuthFailed
+			}
+			return p, nil
+		case <-expired:
+			return Packet{}, errors.New("Timed out authenticating to Gateway")
+		case <-l.closed:
+			return Packet{}, errors.New("Link closed")
+		}
+	}
+
+	clientNonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	hello := append([]byte{authHello}, clientNonce...)
+	l.send(Packet{command: auth, payload: append(hello, deviceID...)})
+
+	p, err := next()
+	if err != nil {
+		return err
+	}
+	if p.payload[0] != authChallenge || len(p.payload) != 1+authNonceSize {
+		return errors.New("Invalid authentication challenge from Gateway")
+	}
+	gatewayNonce := p.payload[1:]
+	response := authMAC(key, "client", deviceID, clientNonce, gatewayNonce)
+	l.send(Packet{command: auth, payload: append([]byte{authResponse}, response...)})
+
+	if p, err = next(); err != nil {
+		return err
+	}
+	if p.payload[0] != authAccepted || !hmac.Equal(p.payload[1:], authMAC(key, "gateway", deviceID, clientNonce, gatewayNonce)) {
+		return errors.New("Gateway failed to prove it knows the key")
+	}
+	l.sessionKey = authMAC(key, "session", deviceID, clientNonce, gatewayNonce)
+	return nil
+}
+
+// Authentication step from the Gateway.
+func (l *Link) handleAuth(packet *Packet) {
+	if len(packet.payload) == 0 {
+		return
+	}
+	select {
+	case l.authEvent <- *packet:
+	default:
+	}
+}
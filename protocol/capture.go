@@ -0,0 +1,334 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Records what crosses a serial link to a pcapng file, for bug reports and replaying later.
+// Every chunk of bytes read from or written to the wire is recorded on interface 0 ("serial"),
+// and every packet decoded from or encoded for it on interface 1 ("packets"), with its integrity check,
+// a direction flag, and a comment describing it. Both use the user link types, 147 and 148.
+//
+// Recording starts a new pcapng section at the end of the file at Path, which is created if needed.
+// Once the file is larger than MaxSize or the section older than MaxAge, the file is renamed to Path
+// with the section's start time added, like "board-20240102-150405.pcapng", and a new one started.
+type Capture struct {
+	Path    string
+	MaxSize int64         // Bytes. Zero means no limit.
+	MaxAge  time.Duration // Zero means no limit.
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	started time.Time
+	err     error
+}
+
+// pcapng link types of the Capture's interfaces.
+const (
+	LinkTypeSerial  = 147 // LINKTYPE_USER0: raw bytes, as read from or written to the wire.
+	LinkTypePackets = 148 // LINKTYPE_USER1: [length][command][payload][integrity check], without framing.
+)
+
+// Direction of captured bytes, as in the pcapng epb_flags option.
+const (
+	captureRX = 1 // inbound
+	captureTX = 2 // outbound
+)
+
+// Interface IDs of the Capture's link types.
+const (
+	captureInterfaceBytes = 0
+	captureInterfacePkts  = 1
+)
+
+// pcapng block types, options and limits.
+const (
+	pcapngSectionHeader  = 0x0A0D0D0A
+	pcapngInterface      = 0x00000001
+	pcapngEnhancedPacket = 0x00000006
+	pcapngByteOrderMagic = 0x1A2B3C4D
+
+	pcapngOptEnd      = 0
+	pcapngOptComment  = 1
+	pcapngOptName     = 2 // if_name
+	pcapngOptFlags    = 2 // epb_flags
+	pcapngOptUserAppl = 4 // shb_userappl
+
+	pcapngMaxSnapLen = 0xFFFF
+)
+
+// Check that the Capture has a path, and limits that make sense.
+func (c *Capture) Validate() error {
+	if c.Path == "" {
+		return errors.New("Capture needs a file path")
+	}
+	if c.MaxSize < 0 || c.MaxAge < 0 {
+		return errors.New("Capture limits must not be negative")
+	}
+	return nil
+}
+
+// Close the capture file. Recording more starts a new section.
+func (c *Capture) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+// Record bytes read from or written to the wire.
+func (c *Capture) bytes(direction uint32, b []byte) error {
+	return c.record(captureInterfaceBytes, direction, b, "")
+}
+
+// Record a serialized packet with its integrity check, decoded in the comment.
+func (c *Capture) packet(direction uint32, ser []byte, p *Packet, check Integrity, ok, windowed bool) error {
+	attrs := packetAttrs(p, check, ok, windowed)
+	var comment strings.Builder
+	for i := 0; i+1 < len(attrs); i += 2 {
+		if i > 0 {
+			comment.WriteByte(' ')
+		}
+		fmt.Fprintf(&comment, "%v=%v", attrs[i], attrs[i+1])
+	}
+	return c.record(captureInterfacePkts, direction, ser, comment.String())
+}
+
+// Write an enhanced packet block, starting a new file first if needed.
+// Once writing fails, nothing more is recorded, and only the first error is returned.
+func (c *Capture) record(iface, direction uint32, data []byte, comment string) error {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return nil
+	}
+	if c.file != nil && (c.MaxSize > 0 && c.size >= c.MaxSize || c.MaxAge > 0 && now.Sub(c.started) >= c.MaxAge) {
+		c.err = c.rotate()
+	}
+	if c.err == nil && c.file == nil {
+		c.err = c.create(now)
+	}
+	if c.err == nil {
+		c.err = c.write(enhancedPacketBlock(iface, direction, now, data, comment))
+	}
+	return c.err
+}
+
+// Close the file and move it aside, named after its start time.
+func (c *Capture) rotate() error {
+	if err := c.file.Close(); err != nil {
+		return err
+	}
+	c.file = nil
+	ext := filepath.Ext(c.Path)
+	name := strings.TrimSuffix(c.Path, ext) + c.started.Format("-20060102-150405")
+	rotated := name + ext
+	for i := 2; fileExists(rotated); i++ {
+		rotated = name + "-" + strconv.Itoa(i) + ext
+	}
+	return os.Rename(c.Path, rotated)
+}
+
+// Open the capture file and start a section with the interfaces.
+func (c *Capture) create(now time.Time) error {
+	f, err := os.OpenFile(c.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	c.file, c.size, c.started = f, info.Size(), now
+	if err = c.write(sectionHeaderBlock()); err != nil {
+		return err
+	}
+	if err = c.write(interfaceBlock(LinkTypeSerial, "serial")); err != nil {
+		return err
+	}
+	return c.write(interfaceBlock(LinkTypePackets, "packets"))
+}
+
+func fileExists(name string) bool {
+	_, err := os.Lstat(name)
+	return err == nil
+}
+
+func (c *Capture) write(block []byte) error {
+	n, err := c.file.Write(block)
+	c.size += int64(n)
+	return err
+}
+
+func sectionHeaderBlock() []byte {
+	body := binary.LittleEndian.AppendUint32(nil, pcapngByteOrderMagic)
+	body = binary.LittleEndian.AppendUint16(body, 1) // version 1.0
+	body = binary.LittleEndian.AppendUint16(body, 0)
+	body = binary.LittleEndian.AppendUint64(body, 0xFFFFFFFFFFFFFFFF) // section length unknown
+	body = appendOption(body, pcapngOptUserAppl, []byte("SerialToTCPBridgeProtocol"))
+	body = appendOption(body, pcapngOptEnd, nil)
+	return block(pcapngSectionHeader, body)
+}
+
+func interfaceBlock(linkType uint16, name string) []byte {
+	body := binary.LittleEndian.AppendUint16(nil, linkType)
+	body = binary.LittleEndian.AppendUint16(body, 0)
+	body = binary.LittleEndian.AppendUint32(body, pcapngMaxSnapLen)
+	body = appendOption(body, pcapngOptName, []byte(name))
+	body = appendOption(body, pcapngOptEnd, nil)
+	return block(pcapngInterface, body)
+}
+
+// Timestamps are in microseconds, the pcapng default resolution.
+func enhancedPacketBlock(iface, direction uint32, t time.Time, data []byte, comment string) []byte {
+	ts := uint64(t.UnixMicro())
+	body := binary.LittleEndian.AppendUint32(nil, iface)
+	body = binary.LittleEndian.AppendUint32(body, uint32(ts>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(ts))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(data)))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(data)))
+	body = appendPadded(body, data)
+	body = appendOption(body, pcapngOptFlags, binary.LittleEndian.AppendUint32(nil, direction))
+	if comment != "" {
+		body = appendOption(body, pcapngOptComment, []byte(comment))
+	}
+	body = appendOption(body, pcapngOptEnd, nil)
+	return block(pcapngEnhancedPacket, body)
+}
+
+// [type][total length][body][total length]
+func block(blockType uint32, body []byte) []byte {
+	total := uint32(len(body) + 12)
+	b := binary.LittleEndian.AppendUint32(make([]byte, 0, total), blockType)
+	b = binary.LittleEndian.AppendUint32(b, total)
+	b = append(b, body...)
+	return binary.LittleEndian.AppendUint32(b, total)
+}
+
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	return appendPadded(b, value)
+}
+
+// Append data padded to 32 bits.
+func appendPadded(b, data []byte) []byte {
+	b = append(b, data...)
+	for n := len(data); n%4 != 0; n++ {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// Whether data starts like a pcapng file, as a Capture writes, rather than raw bytes off the wire.
+func IsCapture(data []byte) bool {
+	return len(data) >= 4 && binary.LittleEndian.Uint32(data) == pcapngSectionHeader
+}
+
+// Raw bytes in a pcapng file written by a Capture, by direction: received by the end that captured them, and sent.
+// Every section of the file is read. Packets of other interfaces than the serial ones are skipped.
+func ReadCapture(r io.Reader) (received, sent []Chunk, err error) {
+	var serial map[uint32]bool // Interfaces of the section with LinkTypeSerial.
+	var iface uint32
+	for {
+		var header [8]byte
+		if _, err = io.ReadFull(r, header[:]); err == io.EOF {
+			return received, sent, nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+		blockType, total := binary.LittleEndian.Uint32(header[:]), binary.LittleEndian.Uint32(header[4:])
+		if total < 12 || total%4 != 0 || total > 1<<24 {
+			return nil, nil, errors.New("Invalid pcapng block length")
+		}
+		body := make([]byte, total-8)
+		if _, err = io.ReadFull(r, body); err != nil {
+			return nil, nil, err
+		}
+		body = body[:len(body)-4]
+
+		switch blockType {
+		case pcapngSectionHeader:
+			if len(body) < 4 || binary.LittleEndian.Uint32(body) != pcapngByteOrderMagic {
+				return nil, nil, errors.New("Not a little endian pcapng file")
+			}
+			serial, iface = make(map[uint32]bool), 0
+		case pcapngInterface:
+			if serial == nil || len(body) < 2 {
+				return nil, nil, errors.New("Invalid pcapng interface block")
+			}
+			serial[iface] = binary.LittleEndian.Uint16(body) == LinkTypeSerial
+			iface++
+		case pcapngEnhancedPacket:
+			if serial == nil || len(body) < 20 {
+				return nil, nil, errors.New("Invalid pcapng packet block")
+			}
+			length := binary.LittleEndian.Uint32(body[12:])
+			padded := 20 + (uint64(length)+3)/4*4
+			if uint64(len(body)) < padded {
+				return nil, nil, errors.New("Invalid pcapng packet block")
+			}
+			if !serial[binary.LittleEndian.Uint32(body)] {
+				continue
+			}
+			ts := uint64(binary.LittleEndian.Uint32(body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(body[8:]))
+			c := Chunk{Time: time.UnixMicro(int64(ts)), Data: body[20 : 20+length]}
+			if packetFlags(body[padded:])&3 == captureTX {
+				sent = append(sent, c)
+			} else {
+				received = append(received, c)
+			}
+		}
+	}
+}
+
+// epb_flags in the options of an enhanced packet block.
+func packetFlags(opts []byte) uint32 {
+	for len(opts) >= 4 {
+		code, length := binary.LittleEndian.Uint16(opts), int(binary.LittleEndian.Uint16(opts[2:]))
+		if code == pcapngOptEnd || len(opts) < 4+length {
+			break
+		}
+		if code == pcapngOptFlags && length == 4 {
+			return binary.LittleEndian.Uint32(opts[4:])
+		}
+		opts = opts[4+(length+3)/4*4:]
+	}
+	return 0
+}
+
+// Record bytes read from or written to com, if capturing.
+func (t *protocolTransport) captureBytes(c *Capture, direction uint32, b []byte) {
+	if c == nil {
+		return
+	}
+	if err := c.bytes(direction, b); err != nil {
+		t.logger.error("Capture failed. Not recording any more", "file", c.Path, "error", err)
+	}
+}
+
+// Record a serialized packet with its integrity check, if capturing.
+func (t *protocolTransport) capturePacket(direction uint32, ser []byte, p *Packet, check Integrity, ok, windowed bool) {
+	if t.capture == nil {
+		return
+	}
+	if err := t.capture.packet(direction, ser, p, check, ok, windowed); err != nil {
+		t.logger.error("Capture failed. Not recording any more", "file", t.capture.Path, "error", err)
+	}
+}
@@ -2,187 +2,921 @@ package protocol
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"errors"
-	"log"
+	"fmt"
+	"io"
 	"net"
+	"os"
 	"strconv"
 	"sync"
 	"time"
 )
 
+// A Dialer contains options for connecting to a server through a protocol Gateway.
+// The zero value dials with the legacy protocol, which every Gateway supports.
+type Dialer struct {
+	// Window asks the Gateway for a sliding window of up to this many unacknowledged publish packets,
+	// instead of waiting for an Ack after every packet. The Gateway may grant a smaller window.
+	// Must be between 0 and 255. Zero or 1 keeps legacy stop-and-wait, which older Gateways require.
+	Window int
+
+	// Streams asks the Gateway to multiplex up to this many concurrent connections over a Link.
+	// The Gateway may grant fewer. Must be between 0 and 255.
+	// Zero or 1 allows a single connection at a time, which older Gateways require.
+	Streams int
+
+	// Timeout is the longest a dial waits for the Gateway to connect to the server.
+	// Zero means DefaultDialTimeout. A context deadline that comes sooner takes precedence.
+	// When the connect carries options anyway (window, streams, UDP, IPv6), the time left is
+	// passed to the Gateway, so it gives up on the server when we give up on it.
+	Timeout time.Duration
+
+	// KeepAlive asks the Gateway to exchange pings over the Link at this interval while it is idle,
+	// so that a dead serial link or Gateway is noticed without any traffic. Zero turns keepalive off,
+	// which older Gateways require. The Gateway may pick another interval.
+	// When the Gateway stops answering, every connection on the Link fails with ReasonKeepAliveTimeout.
+	KeepAlive time.Duration
+
+	// Keepalive intervals in a row without hearing from the Gateway before the Link is dropped.
+	// Zero means DefaultKeepAliveMisses.
+	KeepAliveMisses int
+
+	// DeviceID and Key authenticate the Link to a Gateway that requires it (Gateway.AuthKeys).
+	// If Key is set, NewLink runs the handshake and fails if the Gateway doesn't accept the key.
+	// The key itself is never sent.
+	DeviceID string
+	Key      []byte
+
+	// Encrypt asks for every connection on the Link to be encrypted with AES-GCM, using keys derived
+	// from the authentication handshake. Needs Key. Dials fail if the Gateway doesn't agree.
+	Encrypt bool
+
+	// Compress asks for TCP connections to be compressed with DEFLATE, which helps a lot with
+	// text like JSON on slow links. Gateways that don't support it, or don't want to, leave it off.
+	// Compression statistics are available from connections as CompressionStats().
+	Compress bool
+
+	// How packets are delimited on the serial wire. Must match the Gateway's.
+	// The zero value is the legacy FramingLength.
+	Framing Framing
+
+	// Integrity check to ask the Gateway for, instead of the legacy CRC32.
+	// Gateways that don't support it keep CRC32, which Link.Integrity tells.
+	Integrity Integrity
+
+	// Where the Link logs to, with a "session" attribute identifying it.
+	// Nil means the standard log package, through StdLogger.
+	Logger Logger
+
+	// Log every packet sent and received, decoded, at debug level.
+	Trace bool
+
+	// Records everything sent and received on the serial link to a pcapng file, if set.
+	Capture *Capture
+
+	// Timeouts, retries and buffer sizes of the serial link. The zero value uses the defaults.
+	// How long a dial waits for the Gateway is Timeout.
+	Timings Timings
+}
+
+// Protocol Client side of a serial link to a Gateway.
+// Carries one or more connections, opened with Link.Dial.
+type Link struct {
+	protocolTransport // Connection between Protocol Client & Server/Gateway.
+	dialer            Dialer
+	streams           map[byte]*client
+	streamsLock       sync.Mutex
+	grantedStreams    int           // Streams we may use. 0 until the Gateway has answered a connect.
+	dialing           chan struct{} // Held during a connect handshake.
+	authEvent         chan Packet   // Gateway's authentication steps.
+	sessionKey        []byte        // Derived once authenticated, for encrypted streams.
+	connectCounter    uint32        // Connects signed with the session key so far. Only used while dialing.
+	helloEvent        chan Packet   // Gateway's answer to hello.
+	version           byte          // Protocol version agreed with the Gateway. 0 if we didn't ask.
+	caps              Capabilities  // Capabilities agreed with the Gateway.
+}
+
 // Implementation of the Protocol Client.
+// A single connection to a server, carried over a Link.
 type client struct {
-	protocolTransport // Connection between Protocol Client & Server/Gateway.
-	rxBuffer          bytes.Buffer
-	rxBufLock         sync.RWMutex
-	txBuffer          chan Packet
+	stream
+	link         *Link
+	ownsLink     bool // Link was opened just for this connection, and is closed with it.
+	rxBuffer     bytes.Buffer
+	rxDatagrams  [][]byte // Received datagrams not read yet, on UDP streams.
+	rxBufLock    sync.RWMutex
+	rxReady      chan struct{} // Signalled when data is received.
+	txBuffer     chan Packet
+	connackEvent chan error            // Gateway's answer to connect. Nil for connack, or the reason it refused.
+	err          error                 // Why the connection ended.
+	network      byte                  // Upstream network the Gateway opened.
+	streamNonce  [streamNonceSize]byte // Sent with connect, when asking for encryption.
+	accepted     chan *client          // Inbound connections not accepted yet, on a listen stream.
+	done         chan struct{}         // Closed when the connection ends.
+	doneOnce     sync.Once
+
+	deadlineLock    sync.Mutex
+	readDeadline    time.Time
+	writeDeadline   time.Time
+	deadlineChanged chan struct{} // Closed and replaced whenever a deadline is set, to wake blocked calls.
+
+	localAddr  net.Addr
+	remoteAddr net.Addr
 }
 
 // Dial connection to server.
 func Dial(com serialInterface, address string) (net.Conn, error) {
+	var d Dialer
+	return d.Dial(com, address)
+}
+
+// Open UDP socket to server through the Gateway.
+// The connection has datagram semantics: every Write is sent as one datagram, and every Read returns one.
+func DialUDP(com serialInterface, address string) (net.Conn, error) {
+	var d Dialer
+	return d.DialUDP(com, address)
+}
+
+// Dial connection to server, using the Dialer's options.
+// The connection has the serial link to itself, and closing it releases com.
+func (d *Dialer) Dial(com serialInterface, address string) (net.Conn, error) {
+	return d.dialOwnLink(context.Background(), com, networkTCP, address)
+}
+
+// Dial connection to server, using the Dialer's options.
+// If ctx is done before the connection is made, the dial is abandoned and the Gateway told to stop.
+// Once connected, ctx no longer affects the connection.
+func (d *Dialer) DialContext(ctx context.Context, com serialInterface, address string) (net.Conn, error) {
+	return d.dialOwnLink(ctx, com, networkTCP, address)
+}
+
+// Open UDP socket to server through the Gateway, using the Dialer's options.
+// The connection has the serial link to itself, and closing it releases com.
+func (d *Dialer) DialUDP(com serialInterface, address string) (net.Conn, error) {
+	return d.dialOwnLink(context.Background(), com, networkUDP, address)
+}
+
+func (d *Dialer) dialOwnLink(ctx context.Context, com serialInterface, network byte, address string) (net.Conn, error) {
+	l, err := d.NewLink(com)
+	if err != nil {
+		return nil, err
+	}
+	c, err := l.dial(ctx, network, address)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	c.ownsLink = true
+	return c, nil
+}
+
+// Open a link to a Gateway over com, using the Dialer's options.
+// Connections to servers are then made with Link.Dial.
+func (d *Dialer) NewLink(com serialInterface) (*Link, error) {
 	if com == nil {
 		return nil, errors.New("No serial com interface provided")
 	}
+	if d.Window < 0 || d.Window > 255 {
+		return nil, errors.New("Invalid window size. Must be between 0 and 255")
+	}
+	if d.Streams < 0 || d.Streams > 255 {
+		return nil, errors.New("Invalid number of streams. Must be between 0 and 255")
+	}
+	if d.Timeout < 0 {
+		return nil, errors.New("Invalid dial timeout. Must not be negative")
+	}
+	if len(d.DeviceID) > MaxDeviceIDLength {
+		return nil, errors.New("Device ID too long")
+	}
+	if d.Framing != FramingLength && d.Framing != FramingCOBS {
+		return nil, errors.New("Unknown framing")
+	}
+	if !d.Integrity.valid() {
+		return nil, errors.New("Unknown integrity check")
+	}
+	if d.Encrypt && d.Key == nil {
+		return nil, errors.New("Encryption needs a key to authenticate with")
+	}
+	if d.Capture != nil {
+		if err := d.Capture.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if err := d.Timings.Validate(); err != nil {
+		return nil, err
+	}
+
+	l := &Link{dialer: *d}
+	l.init(com, d.Timings)
+	l.framing = d.Framing
+	l.logger = newLinkLogger(d.Logger, d.Trace, "session", newSessionID())
+	l.capture = d.Capture
+	l.streams = make(map[byte]*client)
+	l.dialing = make(chan struct{}, 1)
+	l.authEvent = make(chan Packet, 1)
+	l.helloEvent = make(chan Packet, 1)
+
+	l.session.Add(2)
+	go l.rxSerial(nil)
+	go l.packetParser(l.handleRxPacket, func() { l.dropLink(ReasonLinkFailure) })
+	go l.txSerial(nil)
+
+	if d.needsHello() {
+		if err := l.hello(); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	if d.Key != nil {
+		err := errors.New("Gateway does not support authentication")
+		if l.supports(CapAuth) {
+			err = l.authenticate()
+		}
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
 
-	c := client{}
-	c.com = com
-	c.rxBuff = make(chan byte, 512)
-	c.acknowledgeEvent = make(chan bool)
-	c.state = Disconnected
-	c.txBuff = make(chan Packet, 2)
-	c.expectedRxSeqFlag = false
-	c.txBuffer = make(chan Packet, 10)
+// Whether the Dialer asks for anything the Gateway might not support, so that we need to ask it first.
+func (d *Dialer) needsHello() bool {
+	return d.Window > 1 || d.Streams > 1 || d.KeepAlive > 0 || d.Key != nil || d.Encrypt || d.Compress ||
+		d.Integrity != IntegrityCRC32
+}
 
-	c.session.Add(3)
-	go c.rxSerial(nil)
-	go c.packetParser(c.handleRxPacket, c.Stop)
-	go c.txSerial(nil)
+// Dial connection to server over the link.
+// Up to Dialer.Streams connections, as granted by the Gateway, can be open at the same time.
+func (l *Link) Dial(address string) (net.Conn, error) {
+	return l.dial(context.Background(), networkTCP, address)
+}
 
+// Dial connection to server over the link.
+// If ctx is done before the connection is made, the dial is abandoned and the Gateway told to stop.
+// Once connected, ctx no longer affects the connection.
+func (l *Link) DialContext(ctx context.Context, address string) (net.Conn, error) {
+	return l.dial(ctx, networkTCP, address)
+}
+
+// Open UDP socket to server through the Gateway, over the link.
+// Counts towards the same stream limit as Link.Dial.
+func (l *Link) DialUDP(address string) (net.Conn, error) {
+	return l.dial(context.Background(), networkUDP, address)
+}
+
+func (l *Link) dial(ctx context.Context, network byte, address string) (*client, error) {
 	host, port, err := net.SplitHostPort(address)
 	if err != nil {
 		return nil, errors.New("Invalid address (" + err.Error() + "). Must be: IP|Host:Port")
 	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil || portNum < 0 || portNum > 0xFFFF {
+		return nil, errors.New("Invalid port: " + port)
+	}
 
-	var cmd byte = connect
-	var connPayload []byte
-	ip := net.ParseIP(host)
-	if ip == nil {
-		// Hostname string
-		cmd |= 0x80
-		connPayload = []byte(host)
-	} else {
-		// IPv4
-		connPayload = ip.To4()
-	}
-	portNum, _ := strconv.Atoi(port)
-	connPayload = append(connPayload, byte(portNum&0x00FF), byte((portNum>>8)&0x00FF))
-
-	c.txBuff <- Packet{command: cmd, payload: connPayload}
+	timeout := l.dialer.Timeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// One connect handshake at a time, as the first one decides how many streams we get.
 	select {
-	case reply, ok := <-c.acknowledgeEvent:
-		if ok && reply {
-			return &c, nil
+	case l.dialing <- struct{}{}:
+		defer func() { <-l.dialing }()
+	case <-ctx.Done():
+		return nil, dialContextError(ctx)
+	}
+
+	channel, ok := l.freeChannel()
+	if !ok {
+		return nil, errors.New("No free streams on link")
+	}
+	// A legacy Gateway would take the options of a connect for its destination, so ask first.
+	if l.version == 0 && (network != networkTCP || isIPv6(host)) {
+		if err = l.hello(); err != nil {
+			return nil, err
 		}
-	case <-time.After(time.Second * 5):
 	}
+	if err = l.checkSupport(network, host); err != nil {
+		return nil, err
+	}
+	c := l.newClient(channel)
+	c.datagram = network == networkUDP
+	c.remoteAddr = makeAddr(network, host, portNum)
+	if network == networkTCPListen {
+		c.accepted = make(chan *client, listenBacklog)
+	}
+	l.streamsLock.Lock()
+	l.streams[channel] = c
+	l.streamsLock.Unlock()
 
-	return nil, errors.New("Timed out while dialing server")
+	var opts connOptions
+	cmd, connPayload := makeConnPayload(host, portNum, &opts)
+	if l.dialer.Window > 1 && l.supports(CapWindow) {
+		opts.window = byte(l.dialer.Window)
+	}
+	if l.dialer.Streams > 1 && channel == 0 && l.supports(CapMultiplex) {
+		opts.streams = byte(l.dialer.Streams)
+	}
+	opts.network = network
+	if l.dialer.KeepAlive > 0 && l.supports(CapKeepAlive) {
+		opts.keepAlive = keepAliveMillis(l.dialer.KeepAlive)
+	}
+	if l.dialer.Compress && network != networkUDP && l.supports(CapCompress) {
+		opts.compress = compressDeflate
+	}
+	if l.dialer.Encrypt {
+		if _, err = rand.Read(opts.streamNonce[:]); err != nil {
+			l.dropStream(c, err)
+			return nil, err
+		}
+		opts.encrypt = true
+		c.streamNonce = opts.streamNonce
+	}
+	if opts != (connOptions{}) {
+		if deadline, ok := ctx.Deadline(); ok && l.supports(CapDialTimeout) {
+			opts.dialTimeout = gatewayDialTimeout(time.Until(deadline))
+		}
+		cmd |= optionsFlag
+		connPayload = append(opts.serialize(), connPayload...)
+	}
+	if l.sessionKey != nil {
+		connPayload = l.signConnect(channel, cmd, connPayload)
+	}
+	if len(connPayload) > c.maxPayload() {
+		err = errors.New("Destination too long for a connect packet")
+		l.dropStream(c, err)
+		return nil, err
+	}
+
+	c.send(Packet{command: cmd, payload: connPayload})
+	select {
+	case err := <-c.connackEvent:
+		if err != nil {
+			l.dropStream(c, err)
+			return nil, err
+		}
+		if c.network != network {
+			c.Close()
+			return nil, errors.New("Gateway does not support " + networkNames[network])
+		}
+		if l.dialer.Encrypt && !c.encrypted() {
+			c.Close()
+			return nil, errors.New("Gateway did not agree to encrypt the connection")
+		}
+		return c, nil
+	case <-ctx.Done():
+	}
+
+	// Tell the Gateway to stop dialing, or to hang up if it got through meanwhile.
+	c.send(disconnectPacket(ReasonClosed))
+	err = dialContextError(ctx)
+	l.dropStream(c, err)
+	return nil, err
+}
+
+// Fail early on a dial the Gateway said it doesn't support.
+func (l *Link) checkSupport(network byte, host string) error {
+	needs := map[byte]Capabilities{networkUDP: CapUDP, networkTCPListen: CapListen | CapMultiplex}[network]
+	if isIPv6(host) {
+		needs |= CapIPv6
+	}
+	if l.dialer.Encrypt {
+		needs |= CapEncrypt
+	}
+	if !l.supports(needs) {
+		return fmt.Errorf("Gateway does not support this connection (capabilities %#04x, needs %#04x)", uint16(l.caps), uint16(needs))
+	}
+	return nil
+}
+
+func isIPv6(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
+
+// Error for a dial whose context is done.
+func dialContextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("Timed out while dialing server: %w", ctx.Err())
+	}
+	return ctx.Err()
+}
+
+// Dial timeout to pass to the Gateway, in milliseconds, when we have remaining left.
+// Leaves a little of it for the Gateway's answer to reach us.
+func gatewayDialTimeout(remaining time.Duration) uint16 {
+	ms := (remaining - remaining/10).Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	if ms > 0xFFFF {
+		ms = 0xFFFF
+	}
+	return uint16(ms)
+}
+
+func (l *Link) newClient(channel byte) *client {
+	c := &client{
+		link:         l,
+		rxReady:      make(chan struct{}, 1),
+		txBuffer:     make(chan Packet, 10),
+		connackEvent: make(chan error, 1),
+		done:         make(chan struct{}),
+
+		deadlineChanged: make(chan struct{}),
+		localAddr:       streamAddr{network: "serial", address: "stream " + strconv.Itoa(int(channel))},
+	}
+	c.stream.init(&l.protocolTransport, channel)
+	return c
 }
 
+// Close the link and every connection on it.
+// The Gateway is told first, and packets already queued are written, for up to closeFlushTimeout.
+func (l *Link) Close() error {
+	l.dropLink(ReasonClosed)
+	l.flush(closeFlushTimeout)
+	l.close()
+	return nil
+}
+
+// Longest a Link that is closing waits for its last packets to be written to the Gateway.
+const closeFlushTimeout = time.Second
+
+// Lowest channel number not in use, within what the Gateway granted.
+func (l *Link) freeChannel() (byte, bool) {
+	l.streamsLock.Lock()
+	defer l.streamsLock.Unlock()
+	n := l.grantedStreams
+	if n == 0 {
+		n = 1 // Only stream 0 until the Gateway tells us otherwise.
+	}
+	for ch := 0; ch < n; ch++ {
+		if _, used := l.streams[byte(ch)]; !used {
+			return byte(ch), true
+		}
+	}
+	return 0, false
+}
+
+func (l *Link) getStream(channel byte) *client {
+	l.streamsLock.Lock()
+	defer l.streamsLock.Unlock()
+	return l.streams[channel]
+}
+
+// Link is connected while any of its connections are.
+func (l *Link) updateState() {
+	l.streamsLock.Lock()
+	defer l.streamsLock.Unlock()
+	connected := false
+	for _, c := range l.streams {
+		connected = connected || c.state.Load() == Connected
+	}
+	l.setConnected(connected)
+}
+
+// End a single connection on the link. err is what reads return once buffered data is used up.
+func (l *Link) dropStream(c *client, err error) {
+	l.streamsLock.Lock()
+	if l.streams[c.channel] == c {
+		delete(l.streams, c.channel)
+	}
+	l.streamsLock.Unlock()
+
+	c.state.Store(Disconnected)
+	c.stopCompression()
+	c.doneOnce.Do(func() {
+		c.rxBufLock.Lock()
+		c.err = err
+		c.rxBufLock.Unlock()
+		close(c.done)
+	})
+	l.updateState()
+}
+
+// End every connection on the link.
+func (l *Link) dropLink(reason DisconnectReason) {
+	l.streamsLock.Lock()
+	streams := make([]*client, 0, len(l.streams))
+	for _, c := range l.streams {
+		streams = append(streams, c)
+	}
+	l.streamsLock.Unlock()
+
+	for _, c := range streams {
+		if c.state.Load() == Connected {
+			c.send(disconnectPacket(reason))
+		}
+		l.dropStream(c, readError(reason))
+	}
+}
+
+// Gateway stopped answering keepalive pings.
+func (l *Link) keepAliveTimeout() {
+	owned := false
+	l.streamsLock.Lock()
+	for _, c := range l.streams {
+		owned = owned || c.ownsLink
+	}
+	l.streamsLock.Unlock()
+
+	l.dropLink(ReasonKeepAliveTimeout)
+	if owned {
+		l.Close()
+	}
+}
+
+// Read blocks until data is received, the connection ends, or the read deadline passes.
+// On a UDP connection, each Read returns one datagram.
 func (c *client) Read(b []byte) (n int, err error) {
-	if c.Available() == 0 {
+	if len(b) == 0 && !c.datagram {
 		return 0, nil
 	}
-	c.rxBufLock.Lock()
-	rByte, err := c.rxBuffer.ReadByte()
-	c.rxBufLock.Unlock()
-	if err != nil {
-		return 0, err
+	for {
+		c.rxBufLock.Lock()
+		if c.datagram && len(c.rxDatagrams) != 0 {
+			// Like a UDP socket, the part of a datagram that doesn't fit in b is discarded.
+			n = copy(b, c.rxDatagrams[0])
+			c.rxDatagrams = c.rxDatagrams[1:]
+			c.rxBufLock.Unlock()
+			return n, nil
+		}
+		if c.rxBuffer.Len() != 0 {
+			n, _ = c.rxBuffer.Read(b)
+			c.rxBufLock.Unlock()
+			return n, nil
+		}
+		err = c.err
+		c.rxBufLock.Unlock()
+		if err != nil {
+			return 0, err
+		}
+
+		expired, changed, stop, err := c.deadlineTimer(&c.readDeadline)
+		if err != nil {
+			return 0, err
+		}
+		select {
+		case <-c.rxReady:
+		case <-c.done:
+		case <-changed:
+		case <-expired:
+			return 0, os.ErrDeadlineExceeded
+		}
+		stop()
 	}
-	b[0] = rByte
-	return 1, nil
 }
 
+// Write blocks until b is queued for the Gateway, the connection ends, or the write deadline passes.
+// Data larger than a packet is split over several packets.
+// On a UDP connection, b is sent as one datagram. Once its first packet is queued,
+// the rest of the datagram is queued regardless of the write deadline.
 func (c *client) Write(b []byte) (n int, err error) {
-	if c.state != Connected {
-		return 0, errors.New("Not connected")
+	if c.state.Load() != Connected {
+		return 0, c.notConnected()
+	}
+
+	// b belongs to the caller once we return, but the packets are sent after that.
+	b = append([]byte(nil), b...)
+	if c.datagram {
+		if len(b) > maxDatagramSize {
+			return 0, errors.New("Datagram too large")
+		}
+		for i, p := range c.fragmentDatagram(b) {
+			if err = c.queue(p, i == 0); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+
+	max := c.maxPayload()
+	if c.compressed() {
+		max = len(b) // compressed as a whole, and split by the sender
+	}
+	for n < len(b) {
+		end := n + max
+		if end > len(b) {
+			end = len(b)
+		}
+		if err = c.queue(Packet{command: publish, payload: b[n:end]}, true); err != nil {
+			return n, err
+		}
+		n = end
 	}
+	return n, nil
+}
+
+// Queue packet for the sender. Gives up when the connection ends or, if deadline is set, when the write deadline passes.
+func (c *client) queue(p Packet, deadline bool) error {
+	for {
+		var expired <-chan time.Time
+		var changed <-chan struct{}
+		stop := func() {}
+		if deadline {
+			var err error
+			if expired, changed, stop, err = c.deadlineTimer(&c.writeDeadline); err != nil {
+				return err
+			}
+		}
+		select {
+		case c.txBuffer <- p:
+			stop()
+			return nil
+		case <-c.done:
+			stop()
+			return c.notConnected()
+		case <-changed:
+			stop()
+		case <-expired:
+			return os.ErrDeadlineExceeded
+		}
+	}
+}
 
-	c.txBuffer <- Packet{command: publish, payload: b}
-	return len(b), nil
+// Timer for a deadline. expired is nil without a deadline, and changed is closed when deadlines are set again.
+// Returns os.ErrDeadlineExceeded if the deadline has passed already.
+func (c *client) deadlineTimer(deadline *time.Time) (expired <-chan time.Time, changed <-chan struct{}, stop func(), err error) {
+	c.deadlineLock.Lock()
+	d := *deadline
+	changed = c.deadlineChanged
+	c.deadlineLock.Unlock()
+
+	stop = func() {}
+	if d.IsZero() {
+		return
+	}
+	remaining := time.Until(d)
+	if remaining <= 0 {
+		return nil, nil, stop, os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(remaining)
+	return timer.C, changed, func() { timer.Stop() }, nil
 }
 
 func (c *client) Close() error {
-	c.Stop()
+	if c.ownsLink {
+		return c.link.Close()
+	}
+	if c.state.Load() == Connected {
+		c.send(disconnectPacket(ReasonClosed))
+	}
+	c.link.dropStream(c, net.ErrClosed)
 	return nil
 }
 
-// To satisfy net.Conn interface
+// Error for writing when the connection has ended.
+func (c *client) notConnected() error {
+	c.rxBufLock.Lock()
+	defer c.rxBufLock.Unlock()
+	if c.err != nil && c.err != io.EOF {
+		return c.err
+	}
+	return errors.New("Not connected")
+}
+
+// Local end of a connection is its stream on the serial link.
+// Connections accepted by a listener have the listener's address instead.
 func (c *client) LocalAddr() net.Addr {
-	return nil
+	return c.localAddr
 }
 
+// Server the connection was dialed to, or the peer an accepted connection came from.
 func (c *client) RemoteAddr() net.Addr {
-	return nil
+	return c.remoteAddr
 }
 
 func (c *client) SetDeadline(t time.Time) error {
+	c.setDeadlines(&t, &t)
 	return nil
 }
 
 func (c *client) SetReadDeadline(t time.Time) error {
+	c.setDeadlines(&t, nil)
 	return nil
 }
 
 func (c *client) SetWriteDeadline(t time.Time) error {
+	c.setDeadlines(nil, &t)
 	return nil
 }
 
+// Set the deadlines that are not nil, and wake blocked calls so that they use them.
+func (c *client) setDeadlines(read, write *time.Time) {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	if read != nil {
+		c.readDeadline = *read
+	}
+	if write != nil {
+		c.writeDeadline = *write
+	}
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+}
+
+// Address of a connection through the Gateway that isn't an IP address, like a hostname or a stream.
+type streamAddr struct {
+	network string
+	address string
+}
+
+func (a streamAddr) Network() string {
+	return a.network
+}
+
+func (a streamAddr) String() string {
+	return a.address
+}
+
+// Address of host and port on the Gateway's network.
+func makeAddr(network byte, host string, port int) net.Addr {
+	ip := net.ParseIP(host)
+	switch {
+	case ip != nil && network == networkUDP:
+		return &net.UDPAddr{IP: ip, Port: port}
+	case ip != nil:
+		return &net.TCPAddr{IP: ip, Port: port}
+	case network == networkUDP:
+		return streamAddr{network: "udp", address: net.JoinHostPort(host, strconv.Itoa(port))}
+	}
+	return streamAddr{network: "tcp", address: net.JoinHostPort(host, strconv.Itoa(port))}
+}
+
 func (c *client) Available() int {
 	c.rxBufLock.Lock()
 	defer c.rxBufLock.Unlock()
-	return c.rxBuffer.Len()
+	n := c.rxBuffer.Len()
+	for _, d := range c.rxDatagrams {
+		n += len(d)
+	}
+	return n
+}
+
+// Bytes sent and received on the connection, before and after compression.
+// All zero if the connection isn't compressed.
+func (c *client) CompressionStats() CompressionStats {
+	return c.compressionStats()
 }
 
 func (c *client) Connected() bool {
-	return c.state == Connected
+	return c.state.Load() == Connected
 }
 
-func (c *client) Stop() {
-	if c.txBuff != nil {
-		close(c.txBuff)
-		c.txBuff = nil
+// Packet RX done. Handle it.
+func (l *Link) handleRxPacket(packet *Packet) {
+	switch packet.command & commandMask {
+	case hello:
+		l.handleHello(packet)
+		return
+	case auth:
+		l.handleAuth(packet)
+		return
 	}
-	if c.rxBuff != nil {
-		close(c.rxBuff)
-		c.rxBuff = nil
+	c := l.getStream(packet.channel)
+	if packet.command&commandMask == connect {
+		l.handleInbound(packet, c)
+		return
+	}
+	if c == nil {
+		return
 	}
-	// close(c.acknowledgeEvent)
-	c.state = Disconnected
-}
 
-// Packet RX done. Handle it.
-func (c *client) handleRxPacket(packet *Packet) {
-	var rxSeqFlag bool = (packet.command & 0x80) > 0
-	switch packet.command & 0x7F {
+	switch packet.command & commandMask {
 	case publish:
 		// Payload from serial client
-		if c.state != Connected {
+		if c.state.Load() != Connected {
 			return
 		}
 
-		c.txBuff <- Packet{command: acknowledge | (packet.command & 0x80)}
-		if rxSeqFlag == c.expectedRxSeqFlag {
-			c.expectedRxSeqFlag = !c.expectedRxSeqFlag
-			c.rxBufLock.Lock()
-			c.rxBuffer.Write(packet.payload)
-			c.rxBufLock.Unlock()
+		if payload, ok := c.acceptPublish(packet); ok {
+			payload, err := c.open(packet, payload)
+			if err != nil {
+				l.logger.warn("Disconnecting from Gateway", "stream", packet.channel, "error", err)
+				c.send(disconnectPacket(ReasonDecryptFailed))
+				l.dropStream(c, ReasonDecryptFailed)
+				return
+			}
+			if c.inflater != nil {
+				if err = c.inflater.write(payload); err != nil {
+					l.logger.warn("Error decompressing. Disconnecting from Gateway", "stream", packet.channel, "error", err)
+					reason := decompressReason(err)
+					c.send(disconnectPacket(reason))
+					l.dropStream(c, reason)
+				}
+				return
+			}
+			if c.datagram {
+				if d, ok := c.reassembleDatagram(packet, payload); ok {
+					c.rxBufLock.Lock()
+					c.rxDatagrams = append(c.rxDatagrams, d)
+					c.rxBufLock.Unlock()
+					c.dataReceived()
+				}
+				return
+			}
+			c.received(payload)
 		}
 	case acknowledge:
-		if c.state == Connected {
-			c.acknowledgeEvent <- rxSeqFlag
-		}
+		c.handleAck(packet)
 	case connack:
-		if c.state != Disconnected {
+		if c.state.Load() != Disconnected {
 			return
 		}
 
-		c.state = Connected
-		c.acknowledgeEvent <- true
-		c.session.Add(1)
-		go c.packetSender(func() (p Packet, err error) {
-			p, ok := <-c.txBuffer
-			if ok {
-				err = nil
-			} else {
-				err = errors.New("channel closed")
+		if packet.command&optionsFlag != 0 {
+			opts, _, err := parseConnOptions(packet.payload)
+			if err != nil {
+				l.logger.warn("Invalid connack options", "stream", packet.channel, "error", err)
+				return
 			}
-			return
-		}, c.Stop)
+			if int(opts.window) <= l.dialer.Window {
+				c.window = int(opts.window)
+			}
+			if opts.streams != 0 && int(opts.streams) <= l.dialer.Streams {
+				l.grantedStreams = int(opts.streams)
+			}
+			c.network = opts.network
+			if opts.compress == compressDeflate && l.dialer.Compress && !c.datagram {
+				c.compress(c.received)
+			}
+			if opts.encrypt && l.dialer.Encrypt && opts.streamNonce == c.streamNonce && l.sessionKey != nil {
+				if tx, rx, err := streamCiphers(l.sessionKey, c.channel, c.streamNonce, false); err == nil {
+					c.encrypt(tx, rx)
+				}
+			}
+			if opts.keepAlive != 0 && l.dialer.KeepAlive > 0 {
+				l.startKeepAlive(time.Duration(opts.keepAlive)*time.Millisecond, l.dialer.KeepAliveMisses, l.keepAliveTimeout)
+			}
+		}
+		if l.grantedStreams == 0 {
+			l.grantedStreams = 1
+		}
+
+		c.state.Store(Connected)
+		l.updateState()
+		c.connackEvent <- nil
+		l.startSender(c)
 	case disconnect:
-		if c.state == Connected {
-			log.Println("Client wants to disconnect. Ending link session")
-			c.Stop()
+		reason := disconnectReason(packet)
+		if c.state.Load() == Connected {
+			l.logger.info("Gateway wants to disconnect. Ending link session", "stream", packet.channel, "reason", reason)
+			l.dropStream(c, readError(reason))
+			if c.ownsLink {
+				l.Close()
+			}
+		} else {
+			// Gateway refused our connect.
+			select {
+			case c.connackEvent <- reason:
+			default:
+			}
+		}
+	}
+}
+
+// Buffer data received on a TCP connection, for Read.
+func (c *client) received(b []byte) error {
+	c.rxBufLock.Lock()
+	c.rxBuffer.Write(b)
+	c.rxBufLock.Unlock()
+	c.dataReceived()
+	return nil
+}
+
+// Wake a blocked Read.
+func (c *client) dataReceived() {
+	select {
+	case c.rxReady <- struct{}{}:
+	default:
+	}
+}
+
+// Start link session, publishing data written to the connection to the Gateway.
+func (l *Link) startSender(c *client) {
+	l.session.Add(1)
+	go c.packetSender(func() (p Packet, err error) {
+		select {
+		case p = <-c.txBuffer:
+		case <-c.done:
+			err = errors.New("connection closed")
 		}
+		return
+	}, func(reason DisconnectReason) { l.dropStream(c, readError(reason)) })
+}
+
+// Error reads return after a disconnect, once buffered data is used up.
+// An orderly close by either end is io.EOF, like any other net.Conn.
+func readError(reason DisconnectReason) error {
+	switch reason {
+	case ReasonClosed, ReasonUpstreamClosed:
+		return io.EOF
 	}
+	return reason
 }
@@ -0,0 +1,165 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// Compressed streams.
+// A Client can ask for a TCP stream to be compressed with the optCompress connect option.
+// Each direction of the stream is then one DEFLATE stream (RFC 1951), shared by all its publish packets
+// so that repetitive data like JSON compresses well even when sent a little at a time.
+// The sender compresses what it has and does a sync flush, so the receiver can decompress everything
+// sent so far without waiting for more. Compressed data is split over as many publish packets as needed.
+// When the stream is encrypted too, compressed data is encrypted.
+const compressDeflate = 1
+
+// Bytes sent and received on a compressed connection, before and after compression.
+type CompressionStats struct {
+	TxBytes           uint64 // Written to the connection.
+	TxCompressedBytes uint64 // Sent over the serial link for that.
+	RxCompressedBytes uint64 // Received over the serial link.
+	RxBytes           uint64 // Read from the connection for that.
+}
+
+// Compressed size of sent data, as a fraction of its size. 0 if nothing was sent.
+func (s CompressionStats) TxRatio() float64 {
+	if s.TxBytes == 0 {
+		return 0
+	}
+	return float64(s.TxCompressedBytes) / float64(s.TxBytes)
+}
+
+// Compressed size of received data, as a fraction of its size. 0 if nothing was received.
+func (s CompressionStats) RxRatio() float64 {
+	if s.RxBytes == 0 {
+		return 0
+	}
+	return float64(s.RxCompressedBytes) / float64(s.RxBytes)
+}
+
+// Compression of one direction of a stream.
+type deflater struct {
+	w       *flate.Writer
+	buf     bytes.Buffer
+	in, out atomic.Uint64
+}
+
+func newDeflater() *deflater {
+	d := &deflater{}
+	d.w, _ = flate.NewWriter(&d.buf, flate.DefaultCompression)
+	return d
+}
+
+// Compress data, flushed so that the receiver can decompress all of it.
+func (d *deflater) compress(data []byte) []byte {
+	d.buf.Reset()
+	d.w.Write(data)
+	d.w.Flush()
+	d.in.Add(uint64(len(data)))
+	d.out.Add(uint64(d.buf.Len()))
+	return append([]byte(nil), d.buf.Bytes()...)
+}
+
+// Decompression of one direction of a stream.
+// Decompressed data is passed to sink in the background, as soon as it is available.
+type inflater struct {
+	pw      *io.PipeWriter
+	in, out atomic.Uint64
+}
+
+func newInflater(sink func([]byte) error) *inflater {
+	pr, pw := io.Pipe()
+	i := &inflater{pw: pw}
+	go func() {
+		r := flate.NewReader(pr)
+		buf := make([]byte, 4096)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				i.out.Add(uint64(n))
+				if sinkErr := sink(buf[:n]); sinkErr != nil {
+					err = sinkErr
+				}
+			}
+			if err != nil {
+				pr.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return i
+}
+
+// Decompress received data. Fails if the data is corrupt, or sink failed on earlier data.
+func (i *inflater) write(compressed []byte) error {
+	i.in.Add(uint64(len(compressed)))
+	_, err := i.pw.Write(compressed)
+	return err
+}
+
+func (i *inflater) close() {
+	i.pw.Close()
+}
+
+// Reason to give the protocol partner when decompressing what it sent failed.
+func decompressReason(err error) DisconnectReason {
+	var corrupt flate.CorruptInputError
+	if errors.As(err, &corrupt) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ReasonProtocolError
+	}
+	return upstreamReason(err)
+}
+
+// Compress the stream. Decompressed data received is passed to sink.
+func (s *stream) compress(sink func([]byte) error) {
+	s.deflater = newDeflater()
+	s.inflater = newInflater(sink)
+}
+
+func (s *stream) compressed() bool {
+	return s.deflater != nil
+}
+
+// Release decompression of the stream, if compressed.
+func (s *stream) stopCompression() {
+	if s.inflater != nil {
+		s.inflater.close()
+	}
+}
+
+func (s *stream) compressionStats() CompressionStats {
+	if s.deflater == nil {
+		return CompressionStats{}
+	}
+	return CompressionStats{
+		TxBytes:           s.deflater.in.Load(),
+		TxCompressedBytes: s.deflater.out.Load(),
+		RxCompressedBytes: s.inflater.in.Load(),
+		RxBytes:           s.inflater.out.Load(),
+	}
+}
+
+// Publish packets of data from getData, compressed and split into packets the stream can carry.
+func (s *stream) compressedSource(getData func() (Packet, error)) func() (Packet, error) {
+	var pending []byte
+	return func() (Packet, error) {
+		for len(pending) == 0 {
+			p, err := getData()
+			if err != nil {
+				return p, err
+			}
+			pending = s.deflater.compress(p.payload)
+		}
+		n := s.maxPayload()
+		if n > len(pending) {
+			n = len(pending)
+		}
+		p := Packet{command: publish, payload: pending[:n]}
+		pending = pending[n:]
+		return p, nil
+	}
+}
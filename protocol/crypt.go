@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// Encrypted streams.
+// A Client that has authenticated (see auth.go) can ask for a stream to be encrypted with the optEncrypt
+// connect option, carrying a random stream nonce. Each direction of the stream then gets its own
+// AES-256-GCM key, derived from the link's session key, the channel and the stream nonce:
+//
+//	session key = HMAC-SHA256(key, "session" | device ID | client nonce | gateway nonce)
+//	stream key  = HMAC-SHA256(session key, "client to gateway" or "gateway to client" | channel | stream nonce)
+//
+// Publish payloads are sealed before they are handed to the sender, so resent packets are identical.
+// The GCM nonce is a count of packets sealed in that direction of the stream. Publish packets are
+// delivered in order and exactly once, so the receiver counts along and the nonce is never sent.
+// The moreFlag of datagram fragments is authenticated too.
+const streamNonceSize = 8
+
+// Ciphers for both directions of a stream. gateway is true on the Gateway's side.
+func streamCiphers(sessionKey []byte, channel byte, streamNonce [streamNonceSize]byte, gateway bool) (tx, rx cipher.AEAD, err error) {
+	derive := func(label string) (cipher.AEAD, error) {
+		mac := hmac.New(sha256.New, sessionKey)
+		mac.Write([]byte(label))
+		mac.Write([]byte{channel})
+		mac.Write(streamNonce[:])
+		block, err := aes.NewCipher(mac.Sum(nil))
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+	toGateway, err := derive("client to gateway")
+	if err != nil {
+		return nil, nil, err
+	}
+	toClient, err := derive("gateway to client")
+	if err != nil {
+		return nil, nil, err
+	}
+	if gateway {
+		return toClient, toGateway, nil
+	}
+	return toGateway, toClient, nil
+}
+
+// Encrypt the stream with ciphers from streamCiphers.
+func (s *stream) encrypt(tx, rx cipher.AEAD) {
+	s.txCipher, s.rxCipher = tx, rx
+	s.txSealed, s.rxOpened = 0, 0
+}
+
+func (s *stream) encrypted() bool {
+	return s.txCipher != nil
+}
+
+func cipherNonce(aead cipher.AEAD, count uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.LittleEndian.PutUint64(nonce, count)
+	return nonce
+}
+
+// Encrypt publish payload, if the stream is encrypted.
+func (s *stream) seal(p Packet) Packet {
+	if s.txCipher == nil {
+		return p
+	}
+	p.payload = s.txCipher.Seal(nil, cipherNonce(s.txCipher, s.txSealed), p.payload, []byte{p.command & moreFlag})
+	s.txSealed++
+	return p
+}
+
+// Decrypt payload of a publish accepted on the stream, if the stream is encrypted.
+func (s *stream) open(p *Packet, payload []byte) ([]byte, error) {
+	if s.rxCipher == nil {
+		return payload, nil
+	}
+	plain, err := s.rxCipher.Open(nil, cipherNonce(s.rxCipher, s.rxOpened), payload, []byte{p.command & moreFlag})
+	if err != nil {
+		return nil, errors.New("publish failed authentication")
+	}
+	s.rxOpened++
+	return plain, nil
+}
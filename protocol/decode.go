@@ -0,0 +1,232 @@
+package protocol
+
+import (
+	"time"
+)
+
+// Bytes received on a serial link at a time, like a chunk of a capture.
+type Chunk struct {
+	Time time.Time // Zero if unknown.
+	Data []byte
+}
+
+// Outcome of decoding a packet from captured bytes.
+type DecodeResult int
+
+const (
+	DecodeOK        DecodeResult = iota // The packet passed its integrity check.
+	DecodeBadCheck                      // The packet failed its integrity check, or its frame was malformed.
+	DecodeTimeout                       // The packet stopped arriving halfway. Only detected when chunks have times.
+	DecodeTruncated                     // The capture ended halfway through the packet.
+)
+
+func (r DecodeResult) String() string {
+	switch r {
+	case DecodeOK:
+		return "ok"
+	case DecodeBadCheck:
+		return "CRCFAIL"
+	case DecodeTimeout:
+		return "timeout"
+	default:
+		return "truncated"
+	}
+}
+
+// Packet, or bytes that failed to make one, decoded from captured bytes.
+type DecodedPacket struct {
+	Offset int64     // Of the packet's first byte, counted from the start of the capture.
+	Time   time.Time // Of the chunk the packet's first byte was in.
+	Result DecodeResult
+
+	// Bytes of the packet, with its integrity check but without framing, as received.
+	// For packets that didn't decode, the bytes read before it failed.
+	Raw []byte
+
+	Command byte   // Without flags. Only valid if the result is DecodeOK or DecodeBadCheck.
+	Name    string // Of the command, like "publish".
+	Channel byte   // Stream the packet belongs to. Only decoded if the result is DecodeOK.
+	Seq     byte   // Sequence flag of publish and acknowledge packets, or their sequence number on windowed streams.
+	Length  byte   // Length byte, counting the bytes after it.
+	Payload []byte // Only set if the result is DecodeOK.
+	Check   Integrity
+
+	// Description of the packet, as alternating keys and values, like the trace of a Gateway.
+	Attrs []any
+}
+
+// Decodes packets from a capture of what one end of a serial link received,
+// with the same framing and integrity checking a Gateway or Client uses, so it can be analyzed offline.
+// Packets are read the way the receiver would have read them: after noise, it stays misaligned just as long.
+type Decoder struct {
+	Framing Framing
+
+	// Integrity check of packets other than hello at the start of the capture.
+	// The Decoder switches to the one a hello packet asks for or grants, unless FixedIntegrity is set.
+	Integrity      Integrity
+	FixedIntegrity bool
+
+	// Longest the receiver waited for the next byte of a packet, as in Timings. Zero means DefaultByteTimeout.
+	ByteTimeout time.Duration
+}
+
+// Decode the chunks of a capture in order, calling fn with every packet found, and every attempt that failed.
+// Chunks with times let the Decoder tell when a packet stopped arriving for longer than the receiver would wait.
+func (d *Decoder) Decode(chunks []Chunk, fn func(DecodedPacket)) {
+	dir := d.newDirection(chunks, new(streamWindows))
+	directions := []*decodeDirection{dir}
+	for {
+		dp, ok := dir.next(directions)
+		if !ok {
+			return
+		}
+		fn(dp)
+	}
+}
+
+// Decode both directions of a link, like those ReadCapture returns, calling fn with every packet found
+// and every attempt that failed, in the order they started to cross the wire. sent is false for received packets.
+// A hello in either direction sets the integrity check of both, as the Gateway's answer is the last word.
+func (d *Decoder) DecodeLink(received, sent []Chunk, fn func(sent bool, p DecodedPacket)) {
+	windows := new(streamWindows) // connects and connacks pass in opposite directions
+	directions := []*decodeDirection{d.newDirection(received, windows), d.newDirection(sent, windows)}
+	for {
+		rx, tx := directions[0], directions[1]
+		dir := rx
+		if rx.done || !tx.done && tx.src.time().Before(rx.src.time()) {
+			dir = tx
+		}
+		dp, ok := dir.next(directions)
+		if !ok {
+			if rx.done && tx.done {
+				return
+			}
+			continue
+		}
+		fn(dir == tx, dp)
+	}
+}
+
+// One direction of a capture being decoded.
+type decodeDirection struct {
+	protocolTransport
+	src            *chunkSource
+	fixedIntegrity bool
+	done           bool // The capture of this direction has been decoded to the end.
+}
+
+func (d *Decoder) newDirection(chunks []Chunk, windows *streamWindows) *decodeDirection {
+	dir := &decodeDirection{src: &chunkSource{chunks: chunks}, fixedIntegrity: d.FixedIntegrity}
+	dir.framing = d.Framing
+	dir.timings = Timings{ByteTimeout: d.ByteTimeout}.WithDefaults()
+	dir.setIntegrity(d.Integrity)
+	dir.windows = windows
+	return dir
+}
+
+// Decode the next packet, or the bytes that failed to make one. false once there is nothing left.
+// A hello sets the integrity check of all directions.
+func (dir *decodeDirection) next(directions []*decodeDirection) (dp DecodedPacket, ok bool) {
+	if dir.done {
+		return dp, false
+	}
+	src := dir.src
+	start, startTime := src.offset, src.time()
+	p, received, result := dir.readPacket(src.next)
+	if result == rxClosed {
+		dir.done = true
+		if len(received) == 0 {
+			return dp, false
+		}
+	}
+	if dir.framing == FramingCOBS {
+		// Leading delimiters and noise don't belong to the packet.
+		start, startTime = src.frameStart, src.frameStartTime
+	}
+	dp = DecodedPacket{Offset: start, Time: startTime, Raw: received, Length: p.length, Command: p.command & commandMask}
+	check := dir.checkFor(p.command)
+	windowed := false
+	switch result {
+	case rxPacket:
+		dp.Result = DecodeOK
+		windowed = p.decodeChannel() && dir.windows.observe(&p)
+		dp.Channel, dp.Payload = p.channel, p.payload
+		if !dir.fixedIntegrity && p.command&commandMask == hello {
+			if _, _, granted, ok := parseHello(&p); ok && granted.valid() {
+				for _, d := range directions {
+					d.setIntegrity(granted)
+				}
+			}
+		}
+	case rxBadPacket:
+		dp.Result = DecodeBadCheck
+	case rxTimedOut:
+		dp.Result = DecodeTimeout
+	default:
+		dp.Result = DecodeTruncated
+	}
+	// Bytes of COBS frames that stopped halfway are still encoded.
+	if result == rxPacket || len(received) >= 2 && (result == rxBadPacket || dir.framing == FramingLength) {
+		dp.Name = commandName(p.command)
+		if dp.Command == publish || dp.Command == acknowledge {
+			dp.Seq, _ = packetSeq(&p, windowed)
+		}
+		dp.Check = check
+		dp.Attrs = packetAttrs(&p, check, result == rxPacket, windowed)
+	}
+	return dp, true
+}
+
+// Byte source over captured chunks. A byte arriving later after the previous one than a timeout
+// is reported as a timeout first, like rxByte would have, and returned by the next call.
+type chunkSource struct {
+	chunks   []Chunk
+	chunk    int   // Current chunk.
+	pos      int   // Next byte in the current chunk.
+	offset   int64 // Of the next byte in the capture.
+	lastTime time.Time
+
+	frameStart     int64 // Offset of the first non-delimiter byte after a delimiter, for COBS.
+	frameStartTime time.Time
+	inFrame        bool
+}
+
+// Move past the chunks read already. false at the end of the capture.
+func (s *chunkSource) skip() bool {
+	for s.chunk < len(s.chunks) && s.pos >= len(s.chunks[s.chunk].Data) {
+		s.chunk++
+		s.pos = 0
+	}
+	return s.chunk < len(s.chunks)
+}
+
+// Time of the next byte's chunk.
+func (s *chunkSource) time() time.Time {
+	if !s.skip() {
+		return time.Time{}
+	}
+	return s.chunks[s.chunk].Time
+}
+
+func (s *chunkSource) next(timeout time.Duration) (b byte, ok bool, timedOut bool) {
+	if !s.skip() {
+		return 0, false, false
+	}
+	c := s.chunks[s.chunk]
+	if timeout > 0 && !c.Time.IsZero() && !s.lastTime.IsZero() && c.Time.Sub(s.lastTime) > timeout {
+		s.lastTime = c.Time
+		s.inFrame = false
+		return 0, false, true
+	}
+	b = c.Data[s.pos]
+	if b == 0 {
+		s.inFrame = false
+	} else if !s.inFrame {
+		s.inFrame = true
+		s.frameStart, s.frameStartTime = s.offset, c.Time
+	}
+	s.pos++
+	s.offset++
+	s.lastTime = c.Time
+	return b, true, false
+}
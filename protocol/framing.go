@@ -0,0 +1,114 @@
+package protocol
+
+import (
+	"time"
+)
+
+// How packets are delimited on the serial wire. Both ends of a link must use the same framing,
+// like they must use the same baud rate, as there is no way to negotiate it before packets can be read.
+type Framing int
+
+const (
+	// Legacy framing, which every partner understands. Packets start with their length byte.
+	// After line noise or a partial packet, the receiver can stay misaligned for several packets.
+	FramingLength Framing = iota
+
+	// Every packet is COBS encoded (Consistent Overhead Byte Stuffing), so that it contains no 0 bytes,
+	// and sent between 0 bytes. The receiver resyncs at the next 0 after noise or a partial packet.
+	// Costs 2 or 3 bytes per packet.
+	FramingCOBS
+)
+
+// Longest COBS encoded packet, without its delimiters.
+const maxCOBSFrame = 256 + 256/254 + 1
+
+// Encode serialized packet with COBS, between frame delimiters.
+func cobsFrame(packet []byte) []byte {
+	frame := make([]byte, 1, len(packet)+len(packet)/254+3)
+	frame[0] = 0
+	code := len(frame)
+	frame = append(frame, 0) // code byte of the first block
+	for _, b := range packet {
+		if b == 0 {
+			frame[code] = byte(len(frame) - code)
+			code = len(frame)
+			frame = append(frame, 0)
+			continue
+		}
+		frame = append(frame, b)
+		if len(frame)-code == 0xFF {
+			frame[code] = 0xFF
+			code = len(frame)
+			frame = append(frame, 0)
+		}
+	}
+	frame[code] = byte(len(frame) - code)
+	return append(frame, 0)
+}
+
+// Decode a COBS frame, without its delimiters. ok is false if it isn't valid COBS.
+func cobsDecode(frame []byte) (packet []byte, ok bool) {
+	packet = make([]byte, 0, len(frame))
+	for i := 0; i < len(frame); {
+		code := int(frame[i])
+		if code == 0 || i+code > len(frame) {
+			return nil, false
+		}
+		packet = append(packet, frame[i+1:i+code]...)
+		i += code
+		if code < 0xFF && i < len(frame) {
+			packet = append(packet, 0)
+		}
+	}
+	return packet, true
+}
+
+// Read the next COBS framed packet.
+// Waits as long as it takes for a frame to start, but not for the rest of it.
+// received is the decoded frame, or the frame as it arrived if it stopped halfway.
+func (t *protocolTransport) readCOBSPacket(rx byteSource) (p Packet, received []byte, result rxResult) {
+	frame := make([]byte, 0, maxCOBSFrame)
+	for {
+		var timeout time.Duration
+		if len(frame) != 0 {
+			timeout = t.timings.ByteTimeout
+		}
+		b, ok, timedOut := rx(timeout)
+		if !ok {
+			return p, frame, lost(timedOut)
+		}
+		if b != 0 {
+			if len(frame) < maxCOBSFrame {
+				frame = append(frame, b)
+			} else {
+				frame = append(frame[:0], 0) // too long, so drop it at the next delimiter
+			}
+			continue
+		}
+		if len(frame) == 0 {
+			continue // delimiter of the previous frame, or noise
+		}
+
+		if p, received, ok = t.parseCOBSFrame(frame); !ok {
+			return p, received, rxBadPacket
+		}
+		return p, received, rxPacket
+	}
+}
+
+// Packet in a COBS frame, if it is valid and passes its integrity check.
+// Otherwise p has the length and command the frame claims, if it has them.
+// received is the decoded frame, with the packet's check.
+func (t *protocolTransport) parseCOBSFrame(frame []byte) (p Packet, received []byte, ok bool) {
+	received, ok = cobsDecode(frame)
+	if !ok || len(received) < 2 {
+		return p, received, false
+	}
+	p.length, p.command = received[0], received[1]
+	check := t.checkFor(p.command)
+	ser, ok := check.verify(received)
+	if !ok || int(ser[0]) != len(ser)-1+check.size() {
+		return p, received, false
+	}
+	return deserialize(ser), received, true
+}
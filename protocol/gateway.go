@@ -1,138 +1,800 @@
 package protocol
 
 import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
 	"encoding/binary"
-	"log"
+	"errors"
 	"net"
 	"strconv"
+	"sync"
+	"time"
 )
 
+// Largest sliding window a Gateway grants when Gateway.MaxWindow is not set.
+const DefaultMaxWindow = 16
+
+// Most streams a Gateway multiplexes over one link when Gateway.MaxStreams is not set.
+const DefaultMaxStreams = 8
+
+// Longest a Gateway waits for a server to accept a connection, and a Client waits for the Gateway,
+// when Gateway.DialTimeout or Dialer.Timeout is not set.
+const DefaultDialTimeout = time.Second * 5
+
 // Implementation of the Protocol Gateway.
 type Gateway struct {
-	protocolTransport          // Connection between Protocol Gateway & Client.
-	uStream           net.Conn // Upstream connection to tcp Server.
+	protocolTransport // Connection between Protocol Gateway & Client.
+	streams           map[byte]*gatewayStream
+	streamsLock       sync.Mutex
+	grantedStreams    int // Streams the Client may use. 1 until multiplexing is negotiated. Set under streamsLock.
+
+	authenticated   bool   // Client on the link has authenticated.
+	authDevice      string // Device authenticating or authenticated.
+	authClientNonce []byte
+	authChallenge   []byte // Gateway nonce of the challenge waiting for a response.
+	sessionKey      []byte // Derived once authenticated, for encrypted streams. Set under streamsLock.
+	connectCounter  uint32 // Of the last connect accepted on the authenticated link.
+
+	linkErr     error // Why downstream interface failed.
+	linkErrOnce *sync.Once
+
+	// Largest sliding window granted to a Client that asks for one.
+	// Zero means DefaultMaxWindow. 1 forces legacy stop-and-wait for every Client.
+	MaxWindow int
+
+	// Most concurrent connections a Client may multiplex over its link, including stream 0.
+	// Zero means DefaultMaxStreams. 1 allows a single connection, like legacy Clients use.
+	MaxStreams int
+
+	// Ports a Client may ask the Gateway to listen on for inbound connections.
+	// Listen requests for other ports are refused. Empty means Clients can't listen at all.
+	ListenPorts []int
+
+	// Longest to wait for an upstream server to accept a connection.
+	// Zero means DefaultDialTimeout. A Client that passes a shorter timeout in its connect gets that instead.
+	DialTimeout time.Duration
+
+	// Interval between keepalive pings to a Client that asked for keepalive, while the link is idle.
+	// Zero uses the interval the Client asked for. Negative turns keepalive down for every Client.
+	KeepAlive time.Duration
+
+	// Keepalive intervals in a row without hearing from the Client before all its connections are dropped.
+	// Zero means DefaultKeepAliveMisses.
+	KeepAliveMisses int
+
+	// Destinations the Client may connect to. Nil allows every destination.
+	// Checked before dialing, and connects it refuses are answered with ReasonPolicyDenied.
+	Policy *Policy
+
+	// Pre-shared keys of the devices that may use the Gateway, by device ID.
+	// If not empty, Clients must authenticate with one of them before any connect is accepted,
+	// and connects before that are refused with ReasonAuthRequired.
+	AuthKeys map[string][]byte
+
+	// Don't compress connections, even if Clients ask for it (Dialer.Compress).
+	DisableCompression bool
+
+	// How packets are delimited on the serial wire. Must match the Client's Dialer.Framing.
+	Framing Framing
+
+	// Refuse connects that don't ask for encryption (Dialer.Encrypt) with ReasonPolicyDenied.
+	// Only authenticated Clients can encrypt, so this needs AuthKeys.
+	RequireEncryption bool
+
+	// Name of the Gateway in its log messages, like the serial port it serves. Optional.
+	Name string
+
+	// Where the Gateway logs to, with "gateway" (if Name is set) and "session" attributes added.
+	// Every Serve is a new session. Nil means the standard log package, through StdLogger.
+	Logger Logger
+
+	// Log every packet sent and received, decoded, at debug level.
+	Trace bool
+
+	// Records everything sent and received on the serial link to a pcapng file, if set.
+	Capture *Capture
+
+	// Timeouts, retries and buffer sizes of the serial link. The zero value uses the defaults.
+	Timings Timings
 }
 
+// Connection made through the Gateway on behalf of the Client.
+type gatewayStream struct {
+	stream
+	network      byte
+	uStream      net.Conn     // Upstream connection to tcp Server.
+	listener     net.Listener // Listening for inbound connections, on a listen stream.
+	connackEvent chan bool    // Client's answer to an inbound connection. Nil for streams the Client opened.
+	dialTimeout  time.Duration
+	cancelDial   context.CancelFunc
+}
+
+// Write data from the Client to the server.
+func (s *gatewayStream) writeUpstream(b []byte) error {
+	n, err := s.uStream.Write(b)
+	s.link.stats.bytesUp.Add(uint64(n))
+	return err
+}
+
+// Longest a Gateway that is shutting down waits for its last packets to be written to the Client.
+const shutdownFlushTimeout = time.Second
+
 // Initialize downstream RX and listen for a protocol Client.
 func (g *Gateway) Listen(ds serialInterface) {
-	g.com = ds
-	g.rxBuff = make(chan byte, 512)
-	g.acknowledgeEvent = make(chan bool)
-	g.state = Disconnected
+	g.Serve(context.Background(), ds)
+}
+
+// Serve a protocol Client on ds, until ctx is done or ds fails.
+// When ctx is done, connected Clients are sent a disconnect, packets already queued are written,
+// upstream connections are closed and ds is released. Returns ctx.Err() then, or the error ds failed with.
+// Invalid Timings are returned as an error straight away.
+func (g *Gateway) Serve(ctx context.Context, ds serialInterface) error {
+	if err := g.Timings.Validate(); err != nil {
+		ds.Close()
+		return err
+	}
+	g.init(ds, g.Timings)
+	g.linkErr, g.linkErrOnce = nil, new(sync.Once)
+	g.framing = g.Framing
+	g.logger = g.newLogger()
+	g.capture = g.Capture
+	g.streams = make(map[byte]*gatewayStream)
+	g.grantedStreams = 1
+	g.authenticated, g.authDevice, g.authChallenge, g.sessionKey = false, "", nil, nil
 
 	g.session.Add(2)
 	go g.rxSerial(g.dropGateway)
-	go g.packetParser(g.handleRxPacket, g.dropLink)
+	go g.packetParser(g.handleRxPacket, func() { g.dropLink(ReasonLinkFailure) })
+	go g.txSerial(g.dropGateway)
+
+	served := make(chan struct{})
+	shutDown := make(chan struct{})
+	go func() {
+		defer close(shutDown)
+		select {
+		case <-ctx.Done():
+			g.shutdown()
+		case <-served:
+		}
+	}()
 	g.session.Wait()
+	close(served)
+	<-shutDown
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return g.linkErr
+}
+
+// Logger of a new session.
+func (g *Gateway) newLogger() linkLogger {
+	var attrs []any
+	if g.Name != "" {
+		attrs = append(attrs, "gateway", g.Name)
+	}
+	return newLinkLogger(g.Logger, g.Trace, append(attrs, "session", newSessionID())...)
 }
 
 // Packet RX done. Handle it.
 func (g *Gateway) handleRxPacket(packet *Packet) {
-	switch packet.command & 0x0F {
+	s := g.getStream(packet.channel)
+
+	switch packet.command & commandMask {
+	case hello:
+		if packet.channel == 0 {
+			g.handleHello(packet)
+		}
+	case auth:
+		if len(g.AuthKeys) != 0 {
+			g.handleAuth(packet)
+		}
 	case publish:
 		// Payload from serial client
-		if g.state == Connected {
-			var rxSeqFlag bool = (packet.command & 0x80) > 0
-			g.txBuff <- Packet{command: acknowledge | (packet.command & 0x80)}
-			if rxSeqFlag == g.expectedRxSeqFlag {
-				g.expectedRxSeqFlag = !g.expectedRxSeqFlag
-				_, err := g.uStream.Write(packet.payload)
+		if s != nil && s.state.Load() == Connected {
+			if payload, ok := s.acceptPublish(packet); ok {
+				payload, err := s.open(packet, payload)
+				if err != nil {
+					g.logger.warn("Disconnecting client", "stream", s.channel, "error", err)
+					s.send(disconnectPacket(ReasonDecryptFailed))
+					g.dropStream(s)
+					return
+				}
+				if s.inflater != nil {
+					if err = s.inflater.write(payload); err != nil {
+						g.logger.warn("Error decompressing. Disconnecting client", "stream", s.channel, "error", err)
+						s.send(disconnectPacket(decompressReason(err)))
+						g.dropStream(s)
+					}
+					return
+				}
+				if s.datagram {
+					if payload, ok = s.reassembleDatagram(packet, payload); !ok {
+						return
+					}
+				}
+				err = s.writeUpstream(payload)
 				if err != nil {
-					log.Printf("Error sending upstream: %v Disconnecting client\n", err)
-					g.txBuff <- Packet{command: disconnect}
-					g.dropLink()
+					g.logger.info("Error sending upstream. Disconnecting client", "stream", s.channel, "error", err)
+					s.send(disconnectPacket(upstreamReason(err)))
+					g.dropStream(s)
 				}
 			}
 		}
 	case acknowledge:
-		if g.state == Connected {
-			var rxSeqFlag bool = (packet.command & 0x80) > 0
-			g.acknowledgeEvent <- rxSeqFlag
+		if s != nil {
+			s.handleAck(packet)
+		}
+	case connack:
+		// Client accepted an inbound connection.
+		if s != nil && s.connackEvent != nil && s.state.Load() == Disconnected {
+			select {
+			case s.connackEvent <- true:
+			default:
+			}
 		}
 	case connect:
-		if g.state != Disconnected {
+		if s != nil {
+			return // already connected or still dialing
+		}
+		g.stats.connectAttempts.Add(1)
+		if len(g.AuthKeys) != 0 && !g.authenticated {
+			g.logger.warn("Connect from unauthenticated Client refused", "stream", packet.channel)
+			g.stats.connectFailures.Add(1)
+			p := disconnectPacket(ReasonAuthRequired)
+			p.channel = packet.channel
+			g.send(p)
+			return
+		}
+		if g.authenticated {
+			payload, ok := g.verifyConnect(packet)
+			if !ok {
+				g.logger.warn("Connect not signed by the authenticated Client refused", "stream", packet.channel)
+				g.stats.connectFailures.Add(1)
+				p := disconnectPacket(ReasonAuthFailed)
+				p.channel = packet.channel
+				g.send(p)
+				return
+			}
+			packet.payload = payload
+		}
+		if int(packet.channel) >= g.grantedStreams {
+			g.logger.warn("Connect on stream that was not negotiated", "stream", packet.channel, "streams", g.grantedStreams)
+			g.stats.connectFailures.Add(1)
+			p := disconnectPacket(ReasonProtocolError)
+			p.channel = packet.channel
+			g.send(p)
 			return
 		}
 
+		s = &gatewayStream{}
+		s.stream.init(&g.protocolTransport, packet.channel)
 		var dstType bool = (packet.command & 0x80) > 0
-		dstStr := makeTCPConnString(packet.payload, dstType)
+		dst := packet.payload
+		var opts connOptions
+		hasOptions := packet.command&optionsFlag != 0
+		if hasOptions {
+			var err error
+			if opts, dst, err = parseConnOptions(dst); err != nil {
+				g.logger.warn("Invalid connect options", "stream", packet.channel, "error", err)
+				g.stats.connectFailures.Add(1)
+				s.send(disconnectPacket(ReasonProtocolError))
+				return
+			}
+		}
+
+		// Refuse before negotiating, which changes the link and starts compression.
+		if g.RequireEncryption && !(opts.encrypt && g.sessionKey != nil) {
+			g.logger.warn("Unencrypted connect refused", "stream", packet.channel)
+			g.stats.connectFailures.Add(1)
+			s.send(disconnectPacket(ReasonPolicyDenied))
+			return
+		}
+		dstStr, err := makeConnString(dst, dstType, opts.family)
+		if err != nil {
+			g.logger.warn("Invalid connect destination", "stream", packet.channel, "error", err)
+			g.stats.connectFailures.Add(1)
+			s.send(disconnectPacket(ReasonProtocolError))
+			return
+		}
 
-		g.txBuff = make(chan Packet, 2)
-		g.expectedRxSeqFlag = false
+		reply := Packet{command: connack}
+		if hasOptions {
+			reply.command |= optionsFlag
+			reply.payload = g.negotiate(s, opts).serialize()
+		} else if packet.channel == 0 {
+			// Legacy Client (re)starting. Nothing it had open before is still in use.
+			g.dropLink(ReasonClosed)
+			g.streamsLock.Lock()
+			g.grantedStreams = 1
+			g.streamsLock.Unlock()
+		}
+		if g.RequireEncryption && !s.encrypted() {
+			g.logger.warn("Encrypting connect failed", "stream", packet.channel)
+			g.stats.connectFailures.Add(1)
+			s.send(disconnectPacket(ReasonPolicyDenied))
+			g.dropStream(s) // stops compression
+			return
+		}
 
-		// Start downstream TX
+		g.streamsLock.Lock()
+		g.streams[s.channel] = s
+		g.streamsLock.Unlock()
+
+		// Dial in the background, so other streams on the link keep flowing meanwhile.
+		ctx, cancel := context.WithTimeout(context.Background(), g.dialTimeout(s))
+		s.cancelDial = cancel
 		g.session.Add(1)
-		go g.txSerial(g.dropGateway)
-
-		// Open connection to upstream server on behalf of client
-		// log.Printf("Gateway: Connect request from client. Dialing to: %v\n", dstStr)
-		var err error
-		if g.uStream, err = net.Dial("tcp", dstStr); err != nil { // TODO: add timeout
-			log.Printf("Gateway: Failed to connect to: %v\n", dstStr)
-			g.txBuff <- Packet{command: disconnect} // TODO: payload to contain error or timeout
-			g.dropLink()
+		go g.openStream(ctx, s, dstStr, reply)
+	case disconnect:
+		if s != nil && s.state.Load() == Connected {
+			g.logger.info("Client wants to disconnect. Ending link session", "stream", packet.channel, "reason", disconnectReason(packet))
+			g.dropStream(s)
+		} else if s != nil && s.connackEvent != nil {
+			// Client refused an inbound connection.
+			select {
+			case s.connackEvent <- false:
+			default:
+			}
+		} else if s != nil && s.cancelDial != nil {
+			// Client gave up waiting for us.
+			s.cancelDial()
+		}
+	}
+}
+
+// Open connection to upstream server on behalf of client, and start the stream's session.
+func (g *Gateway) openStream(ctx context.Context, s *gatewayStream, dstStr string, reply Packet) {
+	defer g.session.Done()
+	defer s.cancelDial()
+	go func() {
+		// Stop dialing if the link goes down meanwhile.
+		select {
+		case <-g.closed:
+			s.cancelDial()
+		case <-ctx.Done():
+		}
+	}()
+
+	network := "tcp"
+	switch s.network {
+	case networkUDP:
+		network = "udp"
+	case networkTCPListen:
+		g.openListener(s, dstStr, reply)
+		return
+	}
+
+	g.logger.debug("Connect request from client", "stream", s.channel, "destination", dstStr)
+	var err error
+	if g.Policy != nil {
+		if dstStr, err = g.checkPolicy(ctx, dstStr); err != nil {
+			g.stats.connectFailures.Add(1)
+			s.send(disconnectPacket(upstreamReason(err)))
+			g.dropStream(s)
 			return
 		}
+	}
+	var d net.Dialer
+	if s.uStream, err = d.DialContext(ctx, network, dstStr); err != nil {
+		g.logger.warn("Failed to connect", "stream", s.channel, "destination", dstStr, "error", err)
+		g.stats.connectFailures.Add(1)
+		s.send(disconnectPacket(upstreamReason(err)))
+		g.dropStream(s)
+		return
+	}
 
-		// Start link session
+	s.state.Store(Connected)
+	g.updateState()
+	s.send(reply)
+	g.startSender(s)
+}
+
+// Start link session, publishing data received from upstream to the Client.
+func (g *Gateway) startSender(s *gatewayStream) {
+	g.session.Add(1)
+	if s.datagram {
+		go s.packetSender(s.datagramSource(), func(DisconnectReason) { g.dropStream(s) })
+		return
+	}
+	tx := make([]byte, s.maxPayload())
+	go s.packetSender(func() (p Packet, err error) {
+		// Publish data downstream received from upstream tcp server.
+		n, err := s.uStream.Read(tx)
+		if err != nil {
+			if err.Error() == "EOF" {
+				g.logger.info("Upstream TCP server closed connection unexpectedly", "stream", s.channel)
+			}
+		} else {
+			s.link.stats.bytesDown.Add(uint64(n))
+			p = Packet{command: publish, payload: tx[:n]}
+		}
+		return
+	}, func(DisconnectReason) { g.dropStream(s) })
+}
+
+// Check destination against the Gateway's policy.
+// Returns the address to dial instead, with a hostname resolved to an address the policy allows.
+func (g *Gateway) checkPolicy(ctx context.Context, dstStr string) (string, error) {
+	host, port, err := net.SplitHostPort(dstStr)
+	if err != nil {
+		return "", err
+	}
+	portNum, _ := strconv.Atoi(port)
+
+	var name string
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		name = host
+		if denied, why := g.Policy.deniesName(name, portNum); denied {
+			g.logger.warn("Policy denied", "destination", dstStr, "rule", why)
+			return "", ReasonPolicyDenied
+		}
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			g.logger.warn("Policy denied", "destination", dstStr, "error", err)
+			return "", err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+
+	allowed, why := g.Policy.check(name, ips, portNum)
+	if len(allowed) == 0 {
+		g.logger.warn("Policy denied", "destination", dstStr, "rule", why)
+		return "", ReasonPolicyDenied
+	}
+	g.logger.info("Policy allowed", "destination", dstStr, "rule", why)
+	return net.JoinHostPort(allowed[0].String(), port), nil
+}
+
+// Listen for inbound connections on behalf of client, and connect each back to it on a stream of its own.
+func (g *Gateway) openListener(s *gatewayStream, dstStr string, reply Packet) {
+	_, port, _ := net.SplitHostPort(dstStr)
+	if !g.listenAllowed(port) {
+		g.logger.warn("Client not allowed to listen", "stream", s.channel, "address", dstStr)
+		g.stats.connectFailures.Add(1)
+		s.send(disconnectPacket(ReasonPolicyDenied))
+		g.dropStream(s)
+		return
+	}
+	var err error
+	if s.listener, err = net.Listen("tcp", dstStr); err != nil {
+		g.logger.warn("Failed to listen", "stream", s.channel, "address", dstStr, "error", err)
+		g.stats.connectFailures.Add(1)
+		s.send(disconnectPacket(upstreamReason(err)))
+		g.dropStream(s)
+		return
+	}
+
+	s.state.Store(Connected)
+	g.updateState()
+	s.send(reply)
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if s.state.Load() == Connected {
+				g.logger.info("Stopped listening", "stream", s.channel, "address", dstStr, "error", err)
+				s.send(disconnectPacket(ReasonUpstreamError))
+				g.dropStream(s)
+			}
+			return
+		}
 		g.session.Add(1)
-		tx := make([]byte, 250) // must be 250 for packet size of 256
-		go g.packetSender(func() (p Packet, err error) {
-			// Publish data downstream received from upstream tcp server.
-			n, err := g.uStream.Read(tx)
+		go g.connectInbound(s, conn)
+	}
+}
+
+func (g *Gateway) listenAllowed(port string) bool {
+	for _, p := range g.ListenPorts {
+		if strconv.Itoa(p) == port {
+			return true
+		}
+	}
+	return false
+}
+
+// Hand inbound connection accepted on a listen stream to the Client.
+// Inbound streams are numbered down from the highest granted channel,
+// while the Client numbers its own from 0 up, to keep them from colliding.
+// Runs on the listener's goroutine, so what the parser sets is read under the lock.
+func (g *Gateway) connectInbound(ls *gatewayStream, conn net.Conn) {
+	defer g.session.Done()
+
+	g.streamsLock.Lock()
+	sessionKey := g.sessionKey
+	channel := -1
+	for ch := g.grantedStreams - 1; ch > 0; ch-- {
+		if _, used := g.streams[byte(ch)]; !used {
+			channel = ch
+			break
+		}
+	}
+	if channel < 0 {
+		g.streamsLock.Unlock()
+		g.logger.warn("No free stream for inbound connection", "remote", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	s := &gatewayStream{
+		network:      networkTCP,
+		uStream:      conn,
+		connackEvent: make(chan bool, 1),
+	}
+	s.stream.init(&g.protocolTransport, byte(channel))
+	s.window = ls.window
+	g.streams[s.channel] = s
+	g.streamsLock.Unlock()
+
+	opts := connOptions{listener: ls.channel, hasListener: true}
+	if s.window > 1 {
+		opts.window = byte(s.window)
+	}
+	if ls.compressed() {
+		s.compress(s.writeUpstream)
+		opts.compress = compressDeflate
+	}
+	if ls.encrypted() {
+		// Inbound connections to an encrypted listener are encrypted too.
+		var tx, rx cipher.AEAD
+		_, err := rand.Read(opts.streamNonce[:])
+		if err == nil {
+			tx, rx, err = streamCiphers(sessionKey, s.channel, opts.streamNonce, true)
+		}
+		if err != nil {
+			g.logger.error("Error encrypting inbound connection", "stream", s.channel, "error", err)
+			g.dropStream(s)
+			return
+		}
+		s.encrypt(tx, rx)
+		opts.encrypt = true
+	}
+	host, port, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	portNum, _ := strconv.Atoi(port)
+	cmd, connPayload := makeConnPayload(host, portNum, &opts)
+	s.send(Packet{command: cmd | optionsFlag, payload: append(opts.serialize(), connPayload...)})
+
+	select {
+	case accepted := <-s.connackEvent:
+		if accepted && ls.state.Load() == Connected {
+			s.state.Store(Connected)
+			g.updateState()
+			g.startSender(s)
+			return
+		}
+	case <-time.After(g.timings.ConnackTimeout):
+	case <-g.closed:
+	}
+	g.dropStream(s)
+}
+
+// Publish datagrams received from upstream udp server, one or more packets each.
+func (s *gatewayStream) datagramSource() func() (Packet, error) {
+	rx := make([]byte, maxDatagramSize)
+	var fragments []Packet
+	return func() (p Packet, err error) {
+		if len(fragments) == 0 {
+			n, err := s.uStream.Read(rx)
 			if err != nil {
-				if err.Error() == "EOF" {
-					log.Println("Upstream TCP server closed connection unexpectedly")
-				}
-			} else {
-				p = Packet{command: publish, payload: tx[:n]}
+				return p, err
 			}
-			return
-		}, g.dropLink)
-		g.state = Connected
-		g.txBuff <- Packet{command: connack}
-	case disconnect:
-		if g.state == Connected {
-			log.Println("Client wants to disconnect. Ending link session")
-			g.dropLink()
+			s.link.stats.bytesDown.Add(uint64(n))
+			fragments = s.fragmentDatagram(rx[:n])
 		}
+		p, fragments = fragments[0], fragments[1:]
+		return p, nil
 	}
 }
 
-// End link session between upstream server and downstream client.
-func (g *Gateway) dropLink() {
-	if g.uStream != nil {
-		g.uStream.Close()
+// How long to wait for the server a stream connects to.
+func (g *Gateway) dialTimeout(s *gatewayStream) time.Duration {
+	timeout := g.DialTimeout
+	if timeout <= 0 {
+		timeout = DefaultDialTimeout
 	}
-	if g.txBuff != nil {
-		close(g.txBuff)
-		g.txBuff = nil
+	if s.dialTimeout > 0 && s.dialTimeout < timeout {
+		timeout = s.dialTimeout
 	}
-	g.state = Disconnected
+	return timeout
 }
 
-// Stop activity and release downstream interface.
-func (g *Gateway) dropGateway() {
-	g.dropLink()
-	g.com.Close()
-	close(g.rxBuff)
-	g.state = TransportNotReady
+// Agree on link options requested by the Client. Returns the options granted.
+func (g *Gateway) negotiate(s *gatewayStream, req connOptions) (granted connOptions) {
+	if req.window != 0 {
+		maxWindow := g.MaxWindow
+		if maxWindow <= 0 {
+			maxWindow = DefaultMaxWindow
+		}
+		if maxWindow > 255 {
+			maxWindow = 255
+		}
+		s.window = int(req.window)
+		if s.window > maxWindow {
+			s.window = maxWindow
+		}
+		granted.window = byte(s.window)
+	}
+	if req.streams != 0 {
+		maxStreams := g.MaxStreams
+		if maxStreams <= 0 {
+			maxStreams = DefaultMaxStreams
+		}
+		if maxStreams > 255 {
+			maxStreams = 255
+		}
+		streams := int(req.streams)
+		if streams > maxStreams {
+			streams = maxStreams
+		}
+		g.streamsLock.Lock()
+		g.grantedStreams = streams
+		g.streamsLock.Unlock()
+		granted.streams = byte(streams)
+	}
+	switch req.network {
+	case networkUDP, networkTCPListen:
+		s.network = req.network
+	}
+	s.datagram = s.network == networkUDP
+	granted.network = s.network
+	if req.compress == compressDeflate && !s.datagram && !g.DisableCompression {
+		// On a listen stream, this compresses the inbound connections it accepts.
+		s.compress(s.writeUpstream)
+		granted.compress = compressDeflate
+	}
+	if req.encrypt && g.sessionKey != nil {
+		tx, rx, err := streamCiphers(g.sessionKey, s.channel, req.streamNonce, true)
+		if err == nil {
+			s.encrypt(tx, rx)
+			granted.encrypt, granted.streamNonce = true, req.streamNonce
+		}
+	}
+	s.dialTimeout = time.Duration(req.dialTimeout) * time.Millisecond
+	if req.keepAlive != 0 && g.KeepAlive >= 0 {
+		interval := g.KeepAlive
+		if interval == 0 {
+			interval = time.Duration(req.keepAlive) * time.Millisecond
+		}
+		granted.keepAlive = keepAliveMillis(interval)
+		g.startKeepAlive(interval, g.KeepAliveMisses, func() { g.dropLink(ReasonKeepAliveTimeout) })
+	}
+	return
 }
 
-// Generate tcp connection string used to dial tcp server from Protocol Client's connect packet payload.
-func makeTCPConnString(connPayload []byte, isHostname bool) string {
-	port := binary.LittleEndian.Uint16(connPayload[len(connPayload)-2:])
-	connString := ""
+func (g *Gateway) getStream(channel byte) *gatewayStream {
+	g.streamsLock.Lock()
+	defer g.streamsLock.Unlock()
+	return g.streams[channel]
+}
 
-	if isHostname {
-		connString = string(connPayload[:len(connPayload)-2])
-	} else {
-		for i := 0; i < 3; i++ {
-			connString += strconv.Itoa(int(connPayload[i])) + "."
+// Link is connected while any of its streams are.
+func (g *Gateway) updateState() {
+	g.streamsLock.Lock()
+	defer g.streamsLock.Unlock()
+	connected := false
+	for _, s := range g.streams {
+		connected = connected || s.state.Load() == Connected
+	}
+	g.setConnected(connected)
+}
+
+// End session between upstream server and downstream client for a single stream.
+func (g *Gateway) dropStream(s *gatewayStream) {
+	g.streamsLock.Lock()
+	if g.streams[s.channel] == s {
+		delete(g.streams, s.channel)
+	}
+	g.streamsLock.Unlock()
+
+	// Disconnected first, so the sender doesn't report the closed connection to the Client as an upstream error.
+	s.state.Store(Disconnected)
+	s.stopCompression()
+	if s.compressed() {
+		stats := s.compressionStats()
+		g.logger.info("Stream compression", "stream", s.channel,
+			"sent", stats.TxBytes, "sent compressed", stats.TxCompressedBytes, "sent ratio", stats.TxRatio(),
+			"received", stats.RxBytes, "received compressed", stats.RxCompressedBytes, "received ratio", stats.RxRatio())
+	}
+	if s.uStream != nil {
+		s.uStream.Close()
+	}
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	g.updateState()
+}
+
+// End link session between upstream server and downstream client, for every stream.
+func (g *Gateway) dropLink(reason DisconnectReason) {
+	g.streamsLock.Lock()
+	streams := make([]*gatewayStream, 0, len(g.streams))
+	for _, s := range g.streams {
+		streams = append(streams, s)
+	}
+	g.streamsLock.Unlock()
+
+	for _, s := range streams {
+		if s.state.Load() == Connected {
+			s.send(disconnectPacket(reason))
 		}
-		connString += strconv.Itoa(int(connPayload[3]))
+		g.dropStream(s)
 	}
-	connString += ":" + strconv.Itoa(int(port))
+}
 
-	return connString
+// Stop activity and release downstream interface, after it failed with err.
+func (g *Gateway) dropGateway(err error) {
+	g.linkErrOnce.Do(func() { g.linkErr = err })
+	g.close()
+	g.dropLink(ReasonLinkFailure)
+}
+
+// Disconnect the Client, and release downstream interface once the disconnects are written.
+func (g *Gateway) shutdown() {
+	g.logger.info("Shutting down")
+	g.dropLink(ReasonClosed)
+	g.flush(shutdownFlushTimeout)
+	g.close()
+}
+
+// Generate connect packet command and payload for a destination host and port.
+// IPv4 addresses and hostnames use the legacy encoding every partner understands.
+// IPv6 addresses need the address family in the options block, so opts.family is set for those.
+func makeConnPayload(host string, port int, opts *connOptions) (cmd byte, connPayload []byte) {
+	cmd = connect
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		// Hostname string
+		cmd |= 0x80
+		connPayload = []byte(host)
+	case ip.To4() != nil:
+		// IPv4
+		connPayload = ip.To4()
+	default:
+		// IPv6
+		opts.family = familyIPv6
+		connPayload = ip.To16()
+	}
+	connPayload = append(connPayload, byte(port&0x00FF), byte((port>>8)&0x00FF))
+	return
+}
+
+// Generate connection string used to dial server from Protocol Client's connect packet payload.
+// family is from the connect options, or 0 for a legacy connect whose command flag tells hostname from IPv4.
+func makeConnString(connPayload []byte, isHostname bool, family byte) (string, error) {
+	if family == 0 {
+		family = familyIPv4
+		if isHostname {
+			family = familyHostname
+		}
+	}
+	if len(connPayload) < 2 {
+		return "", errors.New("destination port missing")
+	}
+	port := binary.LittleEndian.Uint16(connPayload[len(connPayload)-2:])
+	addr := connPayload[:len(connPayload)-2]
+
+	var host string
+	switch family {
+	case familyIPv4:
+		if len(addr) != net.IPv4len {
+			return "", errors.New("IPv4 address must be 4 bytes")
+		}
+		host = net.IP(addr).String()
+	case familyIPv6:
+		if len(addr) != net.IPv6len {
+			return "", errors.New("IPv6 address must be 16 bytes")
+		}
+		host = net.IP(addr).String()
+	case familyHostname:
+		host = string(addr)
+	default:
+		return "", errors.New("unknown address family " + strconv.Itoa(int(family)))
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
 }
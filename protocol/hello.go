@@ -0,0 +1,181 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Version and capabilities exchange.
+// A Client that wants more than the legacy protocol can start its link with a hello packet:
+//
+//	Client:  hello [version][capabilities, 2 bytes little endian][integrity check]
+//	Gateway: hello [version][capabilities, 2 bytes little endian][integrity check]
+//
+// The Gateway answers with the lower of the two versions, and the capabilities both sides have,
+// which is what the Client may then use. It grants the integrity check the Client asked for if it has it,
+// and both sides use that from the next packet on (see integrity.go). Without the field, it is CRC32.
+// More fields may follow in later versions, and are ignored.
+// Legacy Gateways don't answer, and legacy Clients never send hello, so neither notices anything.
+// A hello starts a new session on the link: whatever the Client had open before is dropped.
+const protocolVersion = 2
+
+// Version of the legacy protocol, spoken with partners that don't answer hello.
+const legacyVersion = 1
+
+// Features a protocol partner supports, as advertised in hello.
+type Capabilities uint16
+
+const (
+	CapWindow      Capabilities = 1 << iota // Sliding window (optWindow).
+	CapMultiplex                            // Several streams per link (optStreams).
+	CapUDP                                  // UDP connections.
+	CapListen                               // Inbound connections to listeners on the Gateway.
+	CapIPv6                                 // IPv6 destinations (optFamily).
+	CapDialTimeout                          // Dial timeout from the Client (optDialTimeout).
+	CapKeepAlive                            // Ping and pong (optKeepAlive).
+	CapAuth                                 // Pre-shared key authentication.
+	CapEncrypt                              // Encrypted streams (optEncrypt).
+	CapCompress                             // Compressed streams (optCompress).
+	CapCRC16                                // IntegrityCRC16.
+	CapCRC32C                               // IntegrityCRC32C.
+	CapFEC                                  // IntegrityFEC.
+)
+
+// Everything this implementation supports.
+const allCapabilities = CapWindow | CapMultiplex | CapUDP | CapListen | CapIPv6 | CapDialTimeout |
+	CapKeepAlive | CapAuth | CapEncrypt | CapCompress | CapCRC16 | CapCRC32C | CapFEC
+
+// Times a Client sends hello before deciding the Gateway is a legacy one, and how long it waits for each answer.
+const (
+	helloRetries = 3
+	helloTimeout = time.Millisecond * 300
+)
+
+func helloPacket(version byte, caps Capabilities, check Integrity) Packet {
+	return Packet{command: hello, payload: []byte{version, byte(caps), byte(caps >> 8), byte(check)}}
+}
+
+func parseHello(p *Packet) (version byte, caps Capabilities, check Integrity, ok bool) {
+	if len(p.payload) < 3 || p.payload[0] == 0 {
+		return 0, 0, 0, false
+	}
+	if len(p.payload) > 3 {
+		check = Integrity(p.payload[3])
+	}
+	return p.payload[0], Capabilities(binary.LittleEndian.Uint16(p.payload[1:])), check, true
+}
+
+// Capability needed to use an integrity check. 0 for the legacy CRC32.
+func (i Integrity) capability() Capabilities {
+	switch i {
+	case IntegrityCRC16:
+		return CapCRC16
+	case IntegrityCRC32C:
+		return CapCRC32C
+	case IntegrityFEC:
+		return CapFEC
+	}
+	return 0
+}
+
+// Capabilities the Gateway offers, as configured.
+func (g *Gateway) capabilities() Capabilities {
+	caps := allCapabilities
+	if g.MaxWindow == 1 {
+		caps &^= CapWindow
+	}
+	if g.MaxStreams == 1 {
+		caps &^= CapMultiplex | CapListen
+	}
+	if g.KeepAlive < 0 {
+		caps &^= CapKeepAlive
+	}
+	if len(g.AuthKeys) == 0 {
+		caps &^= CapAuth | CapEncrypt
+	}
+	if g.DisableCompression {
+		caps &^= CapCompress
+	}
+	return caps
+}
+
+// Client (re)starting a session, and asking what we support.
+func (g *Gateway) handleHello(packet *Packet) {
+	version, caps, check, ok := parseHello(packet)
+	if !ok {
+		return
+	}
+	if version > protocolVersion {
+		version = protocolVersion
+	}
+	caps &= g.capabilities()
+	if !check.valid() || caps&check.capability() != check.capability() {
+		check = IntegrityCRC32
+	}
+
+	g.dropLink(ReasonClosed)
+	g.streamsLock.Lock()
+	g.grantedStreams, g.sessionKey = 1, nil
+	g.streamsLock.Unlock()
+	g.authenticated, g.authDevice, g.authChallenge = false, "", nil
+	g.logger.info("Client says hello", "version", version, "capabilities", fmt.Sprintf("%#04x", uint16(caps)), "integrity", check)
+	g.setIntegrity(check)
+	g.send(helloPacket(version, caps, check))
+}
+
+// Find out what the Gateway supports. Gateways that don't answer are taken to be legacy ones.
+func (l *Link) hello() error {
+	for i := 0; i < helloRetries; i++ {
+		l.send(helloPacket(protocolVersion, allCapabilities, l.dialer.Integrity))
+		select {
+		case p := <-l.helloEvent:
+			version, caps, check, _ := parseHello(&p)
+			l.version, l.caps = version, caps&allCapabilities
+			if check != l.dialer.Integrity {
+				check = IntegrityCRC32 // not granted
+			}
+			l.setIntegrity(check)
+			return nil
+		case <-time.After(helloTimeout):
+		case <-l.closed:
+			return errors.New("Link closed")
+		}
+	}
+	l.version, l.caps = legacyVersion, 0
+	return nil
+}
+
+// Gateway's answer to hello.
+func (l *Link) handleHello(packet *Packet) {
+	if _, _, _, ok := parseHello(packet); !ok {
+		return
+	}
+	select {
+	case l.helloEvent <- *packet:
+	default:
+	}
+}
+
+// Protocol version agreed with the Gateway.
+// 0 if nothing dialed or asked of the Dialer so far needed to find out.
+func (l *Link) Version() int {
+	return int(l.version)
+}
+
+// Capabilities both the Gateway and this Client have.
+// Only known if Version is not 0.
+func (l *Link) Capabilities() Capabilities {
+	return l.caps
+}
+
+// Integrity check of packets on the link, as agreed with the Gateway.
+func (l *Link) Integrity() Integrity {
+	return l.checkFor(publish)
+}
+
+// Whether the link may use a feature. If the Gateway wasn't asked, we try and see.
+func (l *Link) supports(caps Capabilities) bool {
+	return l.version == 0 || l.caps&caps == caps
+}
@@ -0,0 +1,347 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"strconv"
+)
+
+// Integrity check carried at the end of every packet.
+// Links start with the legacy CRC32, and a Client can ask for another one in its hello (see hello.go).
+// Once the Gateway agrees, both sides use it for every packet except hello, which always carries a CRC32
+// so that a Client can start a new session whatever was agreed before.
+type Integrity byte
+
+const (
+	// CRC-32 (IEEE), which every partner understands. 4 bytes.
+	IntegrityCRC32 Integrity = iota
+
+	// CRC-16/CCITT-FALSE. 2 bytes, and cheap to compute on small microcontrollers.
+	// Misses more errors than a CRC32, so suits short, clean links.
+	IntegrityCRC16
+
+	// CRC-32C (Castagnoli), which detects more error patterns than CRC-32. 4 bytes.
+	// Many microcontrollers and CPUs compute it in hardware.
+	IntegrityCRC32C
+
+	// Reed-Solomon forward error correction, on top of a CRC-32C. 12 bytes.
+	// Up to 4 corrupted bytes in a packet are corrected without a resend, which helps on long,
+	// noisy RS-232 runs. Errors in the bytes that delimit packets, like the length byte of
+	// FramingLength, still lose the packet.
+	IntegrityFEC
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func (i Integrity) valid() bool {
+	return i <= IntegrityFEC
+}
+
+// Bytes the check adds to a packet.
+func (i Integrity) size() int {
+	switch i {
+	case IntegrityCRC16:
+		return 2
+	case IntegrityFEC:
+		return 4 + fecParity
+	default:
+		return 4
+	}
+}
+
+// Largest payload a packet can carry with the check.
+// The length byte allows 256 byte packets, and a Reed-Solomon codeword is at most 255 bytes.
+func (i Integrity) maxPayload() int {
+	if i == IntegrityFEC {
+		return 255 - 2 - i.size()
+	}
+	return 256 - 2 - i.size()
+}
+
+// Append the check of a serialized packet to it.
+func (i Integrity) appendCheck(ser []byte) []byte {
+	switch i {
+	case IntegrityCRC16:
+		return binary.LittleEndian.AppendUint16(ser, crc16CCITT(ser))
+	case IntegrityCRC32C:
+		return binary.LittleEndian.AppendUint32(ser, crc32.Checksum(ser, crc32cTable))
+	case IntegrityFEC:
+		ser = binary.LittleEndian.AppendUint32(ser, crc32.Checksum(ser, crc32cTable))
+		return append(ser, rsParity(ser)...)
+	default:
+		return binary.LittleEndian.AppendUint32(ser, crc32.ChecksumIEEE(ser))
+	}
+}
+
+// Check a received serialized packet, and return it without its check.
+// With IntegrityFEC, errors are corrected first if possible.
+func (i Integrity) verify(ser []byte) ([]byte, bool) {
+	n := len(ser) - i.size()
+	if n < 2 {
+		return nil, false
+	}
+	switch i {
+	case IntegrityCRC16:
+		return ser[:n], crc16CCITT(ser[:n]) == binary.LittleEndian.Uint16(ser[n:])
+	case IntegrityCRC32C:
+		return ser[:n], crc32.Checksum(ser[:n], crc32cTable) == binary.LittleEndian.Uint32(ser[n:])
+	case IntegrityFEC:
+		corrected, ok := rsCorrect(ser)
+		if !ok {
+			return nil, false
+		}
+		return corrected[:n], crc32.Checksum(corrected[:n], crc32cTable) == binary.LittleEndian.Uint32(corrected[n:])
+	default:
+		return ser[:n], crc32.ChecksumIEEE(ser[:n]) == binary.LittleEndian.Uint32(ser[n:])
+	}
+}
+
+func crc16CCITT(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// Integrity check of a packet with this command on the link. hello is always checked with CRC32.
+func (t *protocolTransport) checkFor(command byte) Integrity {
+	if command&commandMask == hello {
+		return IntegrityCRC32
+	}
+	return Integrity(t.integrity.Load())
+}
+
+func (t *protocolTransport) setIntegrity(i Integrity) {
+	t.integrity.Store(uint32(i))
+}
+
+// Reed-Solomon code over GF(2^8), with fecParity parity bytes per packet, correcting up to fecParity/2
+// byte errors. Primitive polynomial 0x11d, generator roots 2^0 to 2^(fecParity-1).
+// Polynomials are byte slices with the highest degree first, so a packet is a polynomial as it is.
+const fecParity = 8
+
+var (
+	gfExp [512]byte
+	gfLog [256]byte
+	rsGen []byte // Generator polynomial.
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+
+	rsGen = []byte{1}
+	for i := 0; i < fecParity; i++ {
+		rsGen = gfPolyMul(rsGen, []byte{1, gfPow(2, i)})
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])+255-int(gfLog[b]))%255]
+}
+
+func gfPow(x byte, power int) byte {
+	return gfExp[((int(gfLog[x])*power)%255+255)%255]
+}
+
+func gfInverse(x byte) byte {
+	return gfExp[255-int(gfLog[x])]
+}
+
+func gfPolyScale(p []byte, x byte) []byte {
+	r := make([]byte, len(p))
+	for i := range p {
+		r[i] = gfMul(p[i], x)
+	}
+	return r
+}
+
+func gfPolyAdd(p, q []byte) []byte {
+	n := len(p)
+	if len(q) > n {
+		n = len(q)
+	}
+	r := make([]byte, n)
+	for i := range p {
+		r[i+n-len(p)] = p[i]
+	}
+	for i := range q {
+		r[i+n-len(q)] ^= q[i]
+	}
+	return r
+}
+
+func gfPolyMul(p, q []byte) []byte {
+	r := make([]byte, len(p)+len(q)-1)
+	for j := range q {
+		for i := range p {
+			r[i+j] ^= gfMul(p[i], q[j])
+		}
+	}
+	return r
+}
+
+func gfPolyEval(p []byte, x byte) byte {
+	y := p[0]
+	for _, c := range p[1:] {
+		y = gfMul(y, x) ^ c
+	}
+	return y
+}
+
+// Parity bytes to append to msg.
+func rsParity(msg []byte) []byte {
+	rem := make([]byte, len(msg)+fecParity)
+	copy(rem, msg)
+	for i := range msg {
+		coef := rem[i]
+		if coef == 0 {
+			continue
+		}
+		for j := 1; j < len(rsGen); j++ {
+			rem[i+j] ^= gfMul(rsGen[j], coef)
+		}
+	}
+	return rem[len(msg):]
+}
+
+// Syndromes of a codeword, after a leading 0. All 0 if there are no errors.
+func rsSyndromes(codeword []byte) ([]byte, bool) {
+	synd := make([]byte, fecParity+1)
+	clean := true
+	for i := 0; i < fecParity; i++ {
+		synd[i+1] = gfPolyEval(codeword, gfPow(2, i))
+		if synd[i+1] != 0 {
+			clean = false
+		}
+	}
+	return synd, clean
+}
+
+// Correct errors in a codeword (message and parity). ok is false if there are too many to correct.
+func rsCorrect(codeword []byte) (corrected []byte, ok bool) {
+	if len(codeword) > 255 {
+		return nil, false
+	}
+	synd, clean := rsSyndromes(codeword)
+	if clean {
+		return codeword, true
+	}
+
+	// Error locator, with Berlekamp-Massey.
+	errLoc, oldLoc := []byte{1}, []byte{1}
+	for i := 0; i < fecParity; i++ {
+		k := i + 1
+		delta := synd[k]
+		for j := 1; j < len(errLoc); j++ {
+			delta ^= gfMul(errLoc[len(errLoc)-1-j], synd[k-j])
+		}
+		oldLoc = append(oldLoc, 0)
+		if delta != 0 {
+			if len(oldLoc) > len(errLoc) {
+				newLoc := gfPolyScale(oldLoc, delta)
+				oldLoc = gfPolyScale(errLoc, gfInverse(delta))
+				errLoc = newLoc
+			}
+			errLoc = gfPolyAdd(errLoc, gfPolyScale(oldLoc, delta))
+		}
+	}
+	for len(errLoc) > 0 && errLoc[0] == 0 {
+		errLoc = errLoc[1:]
+	}
+	errs := len(errLoc) - 1
+	if errs < 1 || errs*2 > fecParity {
+		return nil, false
+	}
+
+	// Error positions, with a Chien search.
+	reversed := make([]byte, len(errLoc))
+	for i := range errLoc {
+		reversed[i] = errLoc[len(errLoc)-1-i]
+	}
+	var errPos, coefPos []int
+	for i := 0; i < len(codeword); i++ {
+		if gfPolyEval(reversed, gfPow(2, i)) == 0 {
+			errPos = append(errPos, len(codeword)-1-i)
+			coefPos = append(coefPos, i)
+		}
+	}
+	if len(errPos) != errs {
+		return nil, false
+	}
+
+	// Error magnitudes, with Forney's algorithm.
+	locator := []byte{1}
+	for _, p := range coefPos {
+		locator = gfPolyMul(locator, []byte{gfPow(2, p), 1})
+	}
+	syndRev := make([]byte, len(synd))
+	for i := range synd {
+		syndRev[i] = synd[len(synd)-1-i]
+	}
+	product := gfPolyMul(syndRev, locator)
+	evaluator := product[len(product)-len(locator):]
+
+	corrected = append([]byte(nil), codeword...)
+	for i, p := range coefPos {
+		xi := gfPow(2, p)
+		xiInv := gfInverse(xi)
+		locPrime := byte(1)
+		for j, q := range coefPos {
+			if j != i {
+				locPrime = gfMul(locPrime, 1^gfMul(xiInv, gfPow(2, q)))
+			}
+		}
+		if locPrime == 0 {
+			return nil, false
+		}
+		y := gfMul(xi, gfPolyEval(evaluator, xiInv))
+		corrected[errPos[i]] ^= gfDiv(y, locPrime)
+	}
+	if _, clean := rsSyndromes(corrected); !clean {
+		return nil, false
+	}
+	return corrected, true
+}
+
+func (i Integrity) String() string {
+	switch i {
+	case IntegrityCRC32:
+		return "CRC32"
+	case IntegrityCRC16:
+		return "CRC16"
+	case IntegrityCRC32C:
+		return "CRC32C"
+	case IntegrityFEC:
+		return "FEC"
+	}
+	return "Integrity(" + strconv.Itoa(int(i)) + ")"
+}
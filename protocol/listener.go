@@ -0,0 +1,155 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+)
+
+// Inbound connections a listener queues before the Client accepts them.
+// Further connections are refused by the Client until Accept catches up.
+const listenBacklog = 4
+
+// Listener on the Gateway's network, for inbound connections to the Client.
+type listener struct {
+	*client // Listen stream.
+	addr    net.Addr
+}
+
+// Listen for inbound tcp connections on the Gateway's network.
+// The Gateway must allow the port (Gateway.ListenPorts), and multiplexing is used so
+// that each accepted connection gets a stream of its own.
+// The listener has the serial link to itself, and closing it releases com.
+func Listen(com serialInterface, address string) (net.Listener, error) {
+	var d Dialer
+	return d.Listen(com, address)
+}
+
+// Listen for inbound tcp connections on the Gateway's network, using the Dialer's options.
+// If Dialer.Streams is less than 2, DefaultMaxStreams are asked for.
+// The listener has the serial link to itself, and closing it releases com.
+func (d *Dialer) Listen(com serialInterface, address string) (net.Listener, error) {
+	ld := *d
+	if ld.Streams < 2 {
+		ld.Streams = DefaultMaxStreams
+	}
+	l, err := ld.NewLink(com)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := l.listen(address)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	ln.ownsLink = true
+	return ln, nil
+}
+
+// Listen for inbound tcp connections on the Gateway's network, over the link.
+// The listener and every connection it accepts count towards the link's stream limit.
+func (l *Link) Listen(address string) (net.Listener, error) {
+	return l.listen(address)
+}
+
+func (l *Link) listen(address string) (*listener, error) {
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	c, err := l.dial(context.Background(), networkTCPListen, address)
+	if err != nil {
+		return nil, err
+	}
+	if l.grantedStreams < 2 {
+		c.Close()
+		return nil, errors.New("Gateway did not grant enough streams to accept connections")
+	}
+	// The parser may already be handing inbound connections to the listen stream.
+	l.streamsLock.Lock()
+	c.localAddr = addr
+	l.streamsLock.Unlock()
+	return &listener{client: c, addr: addr}, nil
+}
+
+func (ln *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ln.accepted:
+		return c, nil
+	case <-ln.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *listener) Addr() net.Addr {
+	return ln.addr
+}
+
+// Inbound connection the Gateway accepted on one of our listeners.
+// existing is whatever stream already uses the channel.
+func (l *Link) handleInbound(packet *Packet, existing *client) {
+	refuse := func() {
+		p := disconnectPacket(ReasonNoResources)
+		p.channel = packet.channel
+		l.send(p)
+	}
+	if existing != nil || packet.command&optionsFlag == 0 {
+		// Not for us, or it collided with a connection we are dialing on the same channel.
+		refuse()
+		return
+	}
+	opts, connPayload, err := parseConnOptions(packet.payload)
+	if err == nil && !opts.hasListener {
+		err = errors.New("listener missing")
+	}
+	var peer string
+	if err == nil {
+		peer, err = makeConnString(connPayload, packet.command&0x80 != 0, opts.family)
+	}
+	if err != nil {
+		l.logger.warn("Invalid inbound connect from Gateway", "stream", packet.channel, "error", err)
+		refuse()
+		return
+	}
+	ln := l.getStream(opts.listener)
+	if ln == nil || ln.accepted == nil || ln.state.Load() != Connected {
+		refuse()
+		return
+	}
+
+	c := l.newClient(packet.channel)
+	if opts.encrypt {
+		tx, rx, err := streamCiphers(l.sessionKey, c.channel, opts.streamNonce, false)
+		if err != nil || l.sessionKey == nil {
+			refuse()
+			return
+		}
+		c.encrypt(tx, rx)
+	}
+	if opts.compress == compressDeflate {
+		c.compress(c.received)
+	}
+	host, port, _ := net.SplitHostPort(peer)
+	portNum, _ := strconv.Atoi(port)
+	c.remoteAddr = makeAddr(networkTCP, host, portNum)
+	if int(opts.window) <= l.dialer.Window {
+		c.window = int(opts.window)
+	}
+	l.streamsLock.Lock()
+	c.localAddr = ln.localAddr // set by listen under the lock
+	l.streams[c.channel] = c
+	l.streamsLock.Unlock()
+	c.state.Store(Connected)
+	l.updateState()
+	c.send(Packet{command: connack})
+	l.startSender(c)
+
+	select {
+	case ln.accepted <- c:
+	default:
+		l.logger.warn("Listener backlog full. Closing inbound connection", "stream", packet.channel)
+		c.send(disconnectPacket(ReasonNoResources))
+		l.dropStream(c, ReasonNoResources)
+	}
+}
@@ -0,0 +1,190 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// Receives log messages of Gateways and Clients.
+// args are alternating keys and values, so a *slog.Logger from log/slog can be used as is.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// Logger writing to the standard log package, as the message followed by key=value pairs.
+// Used when a Gateway or Dialer has no Logger. Debug messages are dropped unless Verbose is set.
+type StdLogger struct {
+	Verbose bool
+}
+
+func (l StdLogger) Debug(msg string, args ...any) {
+	if l.Verbose {
+		l.print("DEBUG", msg, args)
+	}
+}
+
+func (l StdLogger) Info(msg string, args ...any)  { l.print("INFO", msg, args) }
+func (l StdLogger) Warn(msg string, args ...any)  { l.print("WARN", msg, args) }
+func (l StdLogger) Error(msg string, args ...any) { l.print("ERROR", msg, args) }
+
+func (l StdLogger) print(level, msg string, args []any) {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			fmt.Fprintf(&b, " %v", args[i])
+			break
+		}
+		value := fmt.Sprint(args[i+1])
+		if value == "" || strings.ContainsAny(value, " \"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		fmt.Fprintf(&b, " %v=%s", args[i], value)
+	}
+	log.Println(b.String())
+}
+
+// Logger of a link, adding the link's attributes to every message.
+type linkLogger struct {
+	out   Logger
+	attrs []any
+	trace bool // Log every packet sent and received, at debug level.
+}
+
+func newLinkLogger(out Logger, trace bool, attrs ...any) linkLogger {
+	if out == nil {
+		out = StdLogger{Verbose: trace}
+	}
+	return linkLogger{out: out, attrs: attrs, trace: trace}
+}
+
+func (l *linkLogger) with(args []any) []any {
+	return append(args[:len(args):len(args)], l.attrs...)
+}
+
+func (l *linkLogger) debug(msg string, args ...any) { l.out.Debug(msg, l.with(args)...) }
+func (l *linkLogger) info(msg string, args ...any)  { l.out.Info(msg, l.with(args)...) }
+func (l *linkLogger) warn(msg string, args ...any)  { l.out.Warn(msg, l.with(args)...) }
+func (l *linkLogger) error(msg string, args ...any) { l.out.Error(msg, l.with(args)...) }
+
+// Random ID of a link session, to tell the log messages of one from another.
+func newSessionID() string {
+	id := make([]byte, 4)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+var commandNames = [...]string{
+	connect:     "connect",
+	connack:     "connack",
+	disconnect:  "disconnect",
+	publish:     "publish",
+	acknowledge: "acknowledge",
+	ping:        "ping",
+	pong:        "pong",
+	auth:        "auth",
+	hello:       "hello",
+}
+
+func commandName(command byte) string {
+	if c := int(command & commandMask); c < len(commandNames) {
+		return commandNames[c]
+	}
+	return fmt.Sprintf("command(%d)", command&commandMask)
+}
+
+// Log a packet sent ("TX") or received ("RX"), decoded, if tracing.
+// ok is the result of the integrity check of a received packet.
+func (l *linkLogger) tracePacket(direction string, p *Packet, check Integrity, ok, windowed bool) {
+	if l.trace {
+		l.debug(direction, packetAttrs(p, check, ok, windowed)...)
+	}
+}
+
+// Decoded packet, as alternating keys and values.
+// windowed says the packet's stream uses a sliding window, so its sequence number is in the payload.
+func packetAttrs(p *Packet, check Integrity, ok, windowed bool) []any {
+	args := []any{"command", commandName(p.command), "channel", p.channel, "length", p.length}
+	switch p.command & commandMask {
+	case publish:
+		if seq, ok := packetSeq(p, windowed); ok {
+			args = append(args, "seq", seq)
+		}
+		if p.command&moreFlag != 0 {
+			args = append(args, "more", true)
+		}
+	case acknowledge:
+		if seq, ok := packetSeq(p, windowed); ok {
+			args = append(args, "seq", seq)
+		}
+	case connect:
+		if p.command&0x80 != 0 {
+			args = append(args, "hostname", true)
+		}
+	case disconnect:
+		if len(p.payload) > 0 {
+			args = append(args, "reason", DisconnectReason(p.payload[0]))
+		}
+	}
+	if p.command&optionsFlag != 0 {
+		args = append(args, "options", true)
+	}
+	return append(args, "check", check, "ok", ok)
+}
+
+// Sequence flag of a publish or acknowledge packet, or its sequence number on a windowed stream.
+func packetSeq(p *Packet, windowed bool) (byte, bool) {
+	if !windowed {
+		return p.command >> 7, true
+	}
+	if len(p.payload) == 0 {
+		return 0, false
+	}
+	return p.payload[0], true
+}
+
+// Sliding windows of the streams on a link, as told by the connects and connacks passing over it,
+// so that packets can be decoded without the streams they belong to.
+type streamWindows struct {
+	mu      sync.Mutex
+	asked   [256]byte // By the last connect on each channel.
+	granted [256]byte
+}
+
+// Learn from a packet with its channel decoded, and tell whether its stream uses a sliding window.
+// Until the connack is seen, a stream is taken to have the window its connect asked for.
+// Safe to call on nil, which knows no windows.
+func (w *streamWindows) observe(p *Packet) bool {
+	if w == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ch := p.channel
+	var opts connOptions
+	if p.command&optionsFlag != 0 {
+		opts, _, _ = parseConnOptions(p.payload)
+	}
+	switch p.command & commandMask {
+	case connect:
+		w.asked[ch], w.granted[ch] = opts.window, opts.window
+	case connack:
+		if p.command&optionsFlag != 0 {
+			w.granted[ch] = opts.window
+		} else {
+			w.granted[ch] = w.asked[ch] // answer to an inbound connect, which has the listener's window
+		}
+	case disconnect:
+		w.asked[ch], w.granted[ch] = 0, 0
+	}
+	return w.granted[ch] > 1
+}
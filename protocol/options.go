@@ -0,0 +1,167 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Connect options.
+// A Client that wants more than the legacy protocol sets optionsFlag on its connect command
+// and prefixes the connect payload with an options block. The Gateway replies with a connack,
+// also flagged, whose payload is the options block it agreed to.
+// Legacy Clients never set the flag, so they never see an options block in return.
+//
+// Options block: [total length] followed by [type][length][value...] records.
+// Unknown record types are skipped, so either side can add options without breaking the other.
+const optionsFlag = 0x40
+
+// Option record types.
+const (
+	optWindow      = iota + 1 // Sliding window size. 1 byte.
+	optStreams                // Number of concurrent streams on the link, including stream 0. 1 byte.
+	optNetwork                // Upstream network for the connection. 1 byte. TCP if not present.
+	optListener               // Gateway's connect for an inbound connection: channel of the listener that accepted it. 1 byte.
+	optFamily                 // Address family of the destination that follows the options block. 1 byte.
+	optDialTimeout            // Longest the Client waits for the connection, in milliseconds. 2 bytes, little endian.
+	optKeepAlive              // Keepalive ping interval for the link, in milliseconds. 2 bytes, little endian.
+	optEncrypt                // Encrypt the stream. Random stream nonce, 8 bytes. See crypt.go.
+	optCompress               // Compress the stream. Algorithm, 1 byte: compressDeflate. See compress.go.
+)
+
+// Destination address families.
+// Legacy connects have no optFamily option. Their 0x80 command flag picks between IPv4 and a hostname.
+const (
+	familyIPv4     = iota + 1 // 4 address bytes.
+	familyIPv6                // 16 address bytes.
+	familyHostname            // Hostname or literal address string.
+)
+
+// Upstream networks.
+const (
+	networkTCP = iota
+	networkUDP
+	networkTCPListen // Gateway listens on the address, and connects inbound connections back to the Client.
+)
+
+var networkNames = []string{"TCP", "UDP", "listening"}
+
+type connOptions struct {
+	window  byte // Requested or granted sliding window size. 0 if not present.
+	streams byte // Requested or granted number of multiplexed streams. 0 if not present.
+	network byte // Requested or opened upstream network.
+
+	listener    byte // Listener stream an inbound connection belongs to.
+	hasListener bool
+
+	family byte // Address family of the destination. 0 if not present.
+
+	dialTimeout uint16 // Milliseconds. 0 if not present.
+	keepAlive   uint16 // Requested or granted ping interval in milliseconds. 0 if not present.
+
+	encrypt     bool
+	streamNonce [streamNonceSize]byte
+
+	compress byte // Requested or granted compression algorithm. 0 if not present.
+}
+
+func (o connOptions) serialize() []byte {
+	ser := []byte{0}
+	if o.window != 0 {
+		ser = append(ser, optWindow, 1, o.window)
+	}
+	if o.streams != 0 {
+		ser = append(ser, optStreams, 1, o.streams)
+	}
+	if o.network != networkTCP {
+		ser = append(ser, optNetwork, 1, o.network)
+	}
+	if o.hasListener {
+		ser = append(ser, optListener, 1, o.listener)
+	}
+	if o.family != 0 {
+		ser = append(ser, optFamily, 1, o.family)
+	}
+	if o.dialTimeout != 0 {
+		ser = append(ser, optDialTimeout, 2, byte(o.dialTimeout), byte(o.dialTimeout>>8))
+	}
+	if o.keepAlive != 0 {
+		ser = append(ser, optKeepAlive, 2, byte(o.keepAlive), byte(o.keepAlive>>8))
+	}
+	if o.encrypt {
+		ser = append(append(ser, optEncrypt, streamNonceSize), o.streamNonce[:]...)
+	}
+	if o.compress != 0 {
+		ser = append(ser, optCompress, 1, o.compress)
+	}
+	ser[0] = byte(len(ser) - 1)
+	return ser
+}
+
+// Parse options block at the start of payload. Returns the options and the remainder of the payload.
+func parseConnOptions(payload []byte) (o connOptions, rest []byte, err error) {
+	if len(payload) == 0 || int(payload[0]) > len(payload)-1 {
+		return o, nil, errors.New("options block truncated")
+	}
+	block, rest := payload[1:1+payload[0]], payload[1+payload[0]:]
+	for len(block) > 0 {
+		if len(block) < 2 || int(block[1]) > len(block)-2 {
+			return o, nil, errors.New("option record truncated")
+		}
+		typ, value := block[0], block[2:2+block[1]]
+		block = block[2+block[1]:]
+
+		switch typ {
+		case optWindow:
+			if len(value) == 1 {
+				o.window = value[0]
+			}
+		case optStreams:
+			if len(value) == 1 {
+				o.streams = value[0]
+			}
+		case optNetwork:
+			if len(value) == 1 {
+				o.network = value[0]
+			}
+		case optListener:
+			if len(value) == 1 {
+				o.listener, o.hasListener = value[0], true
+			}
+		case optFamily:
+			if len(value) == 1 {
+				o.family = value[0]
+			}
+		case optDialTimeout:
+			if len(value) == 2 {
+				o.dialTimeout = binary.LittleEndian.Uint16(value)
+			}
+		case optKeepAlive:
+			if len(value) == 2 {
+				o.keepAlive = binary.LittleEndian.Uint16(value)
+			}
+		case optEncrypt:
+			if len(value) == streamNonceSize {
+				o.encrypt = true
+				copy(o.streamNonce[:], value)
+			}
+		case optCompress:
+			if len(value) == 1 {
+				o.compress = value[0]
+			}
+		}
+	}
+	return o, rest, nil
+}
+
+// Keepalive interval as carried in optKeepAlive.
+func keepAliveMillis(interval time.Duration) uint16 {
+	ms := interval.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	if ms > 0xFFFF {
+		ms = 0xFFFF
+	}
+	return uint16(ms)
+}
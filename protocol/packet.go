@@ -1,9 +1,6 @@
 package protocol
 
 import (
-	"encoding/binary"
-	"hash/crc32"
-	"log"
 	"time"
 )
 
@@ -14,153 +11,346 @@ const (
 	disconnect
 	publish
 	acknowledge
+	ping // Keepalive. Answered with pong. Only sent once keepalive is negotiated.
+	pong
+	auth  // Authentication handshake step. See auth.go.
+	hello // Version and capabilities. See hello.go.
+)
+
+// Command byte flags. The low nibble holds the command itself.
+const (
+	commandMask = 0x0F
+	moreFlag    = 0x10 // Publish: datagram continues in the next publish packet. Only used on UDP streams.
+	channelFlag = 0x20 // Packet belongs to a stream other than 0. Its channel number is the first payload byte.
 )
 
 // Protocol packet and helpers.
+// On the wire a packet is [length][command][payload][integrity check], where length counts
+// the bytes after itself.
 type Packet struct {
 	length  byte
 	command byte
+	channel byte
 	payload []byte
-	crc     uint32
+
+	flushed chan struct{} // Not a packet, but closed once the packets queued before it are written.
 }
 
+// Serialized packet, without its integrity check.
 func (p Packet) serialize() []byte {
-	ser := make([]byte, 0, 8)
+	ser := make([]byte, 0, len(p.payload)+2+IntegrityFEC.size())
 	ser = append(ser, p.length)
 	ser = append(ser, p.command)
-	ser = append(ser, p.payload...)
-	crcBytes := make([]byte, 4)
-	binary.LittleEndian.PutUint32(crcBytes, p.crc)
-	ser = append(ser, crcBytes...)
-	return ser
+	return append(ser, p.payload...)
+}
+
+// Packet from serialized bytes that passed their integrity check.
+func deserialize(ser []byte) Packet {
+	return Packet{length: ser[0], command: ser[1], payload: ser[2:]}
 }
 
-func (p Packet) calcCrc() uint32 {
-	return crc32.ChecksumIEEE(p.serialize()[:len(p.payload)+2])
+// Move channel number into the payload for TX.
+// Packets for stream 0 are left as is, so they look the same as legacy packets.
+func (p *Packet) encodeChannel() {
+	if p.channel != 0 {
+		p.command |= channelFlag
+		p.payload = append([]byte{p.channel}, p.payload...)
+	}
+}
+
+// Take channel number out of a received payload.
+func (p *Packet) decodeChannel() bool {
+	if p.command&channelFlag == 0 {
+		return true
+	}
+	if len(p.payload) == 0 {
+		return false
+	}
+	p.channel = p.payload[0]
+	p.payload = p.payload[1:]
+	p.command &^= channelFlag
+	return true
 }
 
+// Source of received bytes, like protocolTransport.rxByte. Waits forever if timeout is 0.
+type byteSource func(timeout time.Duration) (b byte, ok bool, timedOut bool)
+
+// Outcome of reading a packet off the wire.
+type rxResult int
+
+const (
+	rxPacket    rxResult = iota // Passed its integrity check.
+	rxBadPacket                 // Failed its integrity check, or was malformed.
+	rxTimedOut                  // Stopped arriving halfway through.
+	rxClosed                    // No more bytes.
+)
+
 // Parse RX buffer for legitimate packets.
+// The link is dropped after Timings.MaxRxErrors bad or stalled packets in a row while connected.
+// Parsing goes on, so that the protocol partner can connect again once the line is good.
 func (t *protocolTransport) packetParser(packetHandler func(*Packet), onTimeout func()) {
 	defer t.session.Done()
-	timeouts := 0
-PACKET_RX_LOOP:
+	errs := 0
 	for {
-		if timeouts >= 5 {
-			if t.state == Connected {
-				log.Println("RX packet timeout")
-				t.txBuff <- Packet{command: disconnect}
+		if errs >= t.timings.MaxRxErrors {
+			if t.state.Load() == Connected {
+				t.logger.warn("RX packet timeout")
 				if onTimeout != nil {
 					onTimeout()
 				}
-				return
 			}
-			timeouts = 0
+			errs = 0
 		}
 
-		p := Packet{}
-		var ok bool
-
-		// Length byte
-		p.length, ok = <-t.rxBuff
-		if !ok {
+		p, received, result := t.readPacket(t.rxByte)
+		switch result {
+		case rxClosed:
 			return
+		case rxTimedOut:
+			t.stats.rxTimeouts.Add(1)
+			errs++
+		case rxBadPacket:
+			check := t.checkFor(p.command)
+			t.logger.warn("RX packet CRCFAIL")
+			t.logger.tracePacket("RX", &p, check, false, false)
+			t.capturePacket(captureRX, received, &p, check, false, false)
+			t.stats.integrityFailures.Add(1)
+			errs++
+		default:
+			errs = 0
+			t.dispatch(&p, received, packetHandler)
 		}
+	}
+}
 
-		// Command byte
-		select {
-		case p.command, ok = <-t.rxBuff:
-			if !ok {
-				return
-			}
-		case <-time.After(time.Millisecond * 100):
-			timeouts++
-			continue PACKET_RX_LOOP // discard
-		}
+// Read the next packet off rx, with the link's framing.
+// received is the packet as it arrived, with its integrity check, or the bytes read before it failed.
+func (t *protocolTransport) readPacket(rx byteSource) (p Packet, received []byte, result rxResult) {
+	if t.framing == FramingCOBS {
+		return t.readCOBSPacket(rx)
+	}
+	return t.readLengthPacket(rx)
+}
 
-		// Payload
-		for i := 0; i < int(p.length)-5; i++ {
-			select {
-			case payloadByte, ok := <-t.rxBuff:
-				if !ok {
-					return
-				}
-				p.payload = append(p.payload, payloadByte)
-			case <-time.After(time.Millisecond * 100):
-				timeouts++
-				continue PACKET_RX_LOOP
-			}
-		}
+// Read the next packet that starts with its length byte.
+func (t *protocolTransport) readLengthPacket(rx byteSource) (p Packet, received []byte, result rxResult) {
+	var ok, timedOut bool
 
-		// CRC32
-		rxCrc := make([]byte, 0, 4)
-		for i := 0; i < 4; i++ {
-			select {
-			case crcByte, ok := <-t.rxBuff:
-				if !ok {
-					return
-				}
-				rxCrc = append(rxCrc, crcByte)
-			case <-time.After(time.Millisecond * 100):
-				timeouts++
-				continue PACKET_RX_LOOP
-			}
-		}
-		p.crc = binary.LittleEndian.Uint32(rxCrc)
+	// Length byte
+	p.length, ok, _ = rx(0)
+	if !ok {
+		return p, nil, rxClosed
+	}
 
-		// Integrity Checking
-		if p.calcCrc() != p.crc {
-			log.Println("RX packet CRCFAIL")
-			timeouts++
-			continue PACKET_RX_LOOP
+	// Command byte
+	p.command, ok, timedOut = rx(t.timings.ByteTimeout)
+	if !ok {
+		return p, []byte{p.length}, lost(timedOut)
+	}
+
+	// Payload and integrity check
+	check := t.checkFor(p.command)
+	received = make([]byte, 2, int(p.length)+1)
+	received[0], received[1] = p.length, p.command
+	for i := 0; i < int(p.length)-1; i++ {
+		b, ok, timedOut := rx(t.timings.ByteTimeout)
+		if !ok {
+			return p, received, lost(timedOut)
 		}
-		timeouts = 0
-		packetHandler(&p)
+		received = append(received, b)
+	}
+
+	// Integrity Checking
+	ser, ok := check.verify(received)
+	if !ok {
+		return p, received, rxBadPacket
+	}
+	return deserialize(ser), received, rxPacket
+}
+
+func lost(timedOut bool) rxResult {
+	if timedOut {
+		return rxTimedOut
+	}
+	return rxClosed
+}
+
+// Handle a packet that passed its CRC check. received is the packet as it arrived, with its check.
+func (t *protocolTransport) dispatch(p *Packet, received []byte, packetHandler func(*Packet)) {
+	t.rxActivity.Store(true)
+	t.stats.framesReceived.Add(1)
+	ok := p.decodeChannel()
+	windowed := ok && t.windowed(p)
+	t.logger.tracePacket("RX", p, t.checkFor(p.command), true, windowed)
+	t.capturePacket(captureRX, received, p, t.checkFor(p.command), true, windowed)
+	if !ok {
+		return
+	}
+	switch p.command & commandMask {
+	case ping:
+		t.send(Packet{command: pong})
+	case pong:
+	default:
+		packetHandler(p)
 	}
 }
 
 // Publish data over Serial interface.
 // We need to get an Ack before sending the next publish packet.
-// Resend same publish packet after timeout, and kill link after 5 retries.
-func (t *protocolTransport) packetSender(getData func() (Packet, error), onError func()) {
-	defer t.session.Done()
-	sequenceTxFlag := false
+// Resend same publish packet after Timings.AckTimeout, and kill link after Timings.MaxRetries retries.
+// onError gets the reason sent to the protocol partner in the disconnect packet.
+func (s *stream) packetSender(getData func() (Packet, error), onError func(DisconnectReason)) {
+	defer s.link.session.Done()
+	if s.deflater != nil {
+		getData = s.compressedSource(getData)
+	}
+	if s.window > 1 {
+		s.windowedPacketSender(getData, onError)
+		return
+	}
+	var sequenceTxFlag byte
 	retries := 0
 	for {
 		p, err := getData()
 		if err != nil {
-			if t.state == Connected {
-				log.Printf("Error receiving data: %v. Disconnecting from Protocol partner\n", err)
-				t.txBuff <- Packet{command: disconnect}
+			if s.state.Load() == Connected {
+				s.link.logger.info("Error receiving data. Disconnecting from Protocol partner", "stream", s.channel, "error", err)
+				reason := upstreamReason(err)
+				s.send(disconnectPacket(reason))
 				if onError != nil {
-					onError()
+					onError(reason)
 				}
 			}
 			return
 		}
-		if sequenceTxFlag {
-			p.command |= 0x80
-		}
+		p = s.seal(p)
+		p.command |= sequenceTxFlag << 7
 	PUB_LOOP:
 		for {
-			t.txBuff <- p
+			s.send(p)
 			select {
-			case ack, ok := <-t.acknowledgeEvent:
+			case ack, ok := <-s.acknowledgeEvent:
 				if ok && ack == sequenceTxFlag {
 					retries = 0
-					sequenceTxFlag = !sequenceTxFlag
+					sequenceTxFlag ^= 1
 					break PUB_LOOP // success
 				}
-			case <-time.After(time.Millisecond * 500):
+			case <-time.After(s.link.timings.AckTimeout):
 				retries++
-				if retries >= 5 {
-					log.Println("Too many tx serial retries. Disconnecting from Protocol partner")
-					t.txBuff <- Packet{command: disconnect}
+				if retries >= s.link.timings.MaxRetries {
+					s.link.logger.warn("Too many tx serial retries. Disconnecting from Protocol partner", "stream", s.channel)
+					s.link.stats.retriesExhausted.Add(1)
+					s.send(disconnectPacket(ReasonLinkFailure))
 					if onError != nil {
-						onError()
+						onError(ReasonLinkFailure)
 					}
 					return
 				}
+				s.link.stats.retransmits.Add(1)
+			case <-s.link.closed:
+				return
+			}
+		}
+	}
+}
+
+// Publish data over Serial interface using a Go-Back-N sliding window.
+// Up to s.window publish packets can be unacknowledged at a time, each carrying an 8-bit sequence number
+// as the first payload byte. Acks are cumulative. After a timeout, every unacknowledged packet is resent,
+// and the link is killed after Timings.MaxRetries retries without progress.
+func (s *stream) windowedPacketSender(getData func() (Packet, error), onError func(DisconnectReason)) {
+	// Fetch data in the background so we can keep handling acks while getData blocks.
+	data := make(chan Packet)
+	dataErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			p, err := getData()
+			if err != nil {
+				dataErr <- err
+				return
+			}
+			// getData may reuse its buffer, and the packet can still be resent later.
+			p = s.seal(p)
+			p.payload = append([]byte{0}, p.payload...)
+			select {
+			case data <- p:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var (
+		inFlight []Packet
+		nextSeq  byte
+		retries  int
+		srcErr   error
+		timeout  <-chan time.Time // Running while packets are unacknowledged.
+	)
+
+	fail := func(reason DisconnectReason) {
+		s.send(disconnectPacket(reason))
+		if onError != nil {
+			onError(reason)
+		}
+	}
+
+	for {
+		if srcErr != nil && len(inFlight) == 0 {
+			// Everything sent before the data source failed has been delivered.
+			if s.state.Load() == Connected {
+				s.link.logger.info("Error receiving data. Disconnecting from Protocol partner", "stream", s.channel, "error", srcErr)
+				fail(upstreamReason(srcErr))
+			}
+			return
+		}
+
+		var newData <-chan Packet
+		if srcErr == nil && len(inFlight) < s.window {
+			newData = data
+		}
+
+		select {
+		case p := <-newData:
+			p.payload[0] = nextSeq
+			nextSeq++
+			inFlight = append(inFlight, p)
+			if len(inFlight) == 1 {
+				timeout = time.After(s.link.timings.AckTimeout)
+			}
+			s.send(p)
+		case srcErr = <-dataErr:
+		case <-s.link.closed:
+			return
+		case ack, ok := <-s.acknowledgeEvent:
+			if !ok || len(inFlight) == 0 {
+				continue
+			}
+			acked := int(ack-inFlight[0].payload[0]) + 1
+			if acked > len(inFlight) {
+				continue // stale ack
+			}
+			inFlight = inFlight[acked:]
+			retries = 0
+			timeout = nil
+			if len(inFlight) > 0 {
+				timeout = time.After(s.link.timings.AckTimeout)
+			}
+		case <-timeout:
+			retries++
+			if retries >= s.link.timings.MaxRetries {
+				s.link.logger.warn("Too many tx serial retries. Disconnecting from Protocol partner", "stream", s.channel)
+				s.link.stats.retriesExhausted.Add(1)
+				fail(ReasonLinkFailure)
+				return
+			}
+			s.link.stats.retransmits.Add(uint64(len(inFlight)))
+			for _, p := range inFlight {
+				s.send(p)
 			}
+			timeout = time.After(s.link.timings.AckTimeout)
 		}
 	}
 }
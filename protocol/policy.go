@@ -0,0 +1,148 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Destinations a Gateway may connect to on behalf of its Client.
+// A destination is refused if it matches any Deny rule. If there are Allow rules, it must also match one of them.
+// Hostnames are resolved before they are checked, and the Gateway connects to an address that passed,
+// so a hostname can't be used to reach a denied network.
+type Policy struct {
+	Allow []PolicyRule `json:"allow"`
+	Deny  []PolicyRule `json:"deny"`
+}
+
+// Destinations on one of Hosts, at one of Ports.
+type PolicyRule struct {
+	// CIDRs ("10.0.0.0/8"), IP addresses, or hostnames in which "*" matches any part of the name ("*.example.com").
+	// Empty matches any host.
+	Hosts []string `json:"hosts"`
+
+	// Ports ("80") or inclusive port ranges ("8000-8100"). Empty matches any port.
+	Ports []string `json:"ports"`
+}
+
+// Check that every host and port in the policy's rules is well formed.
+func (p *Policy) Validate() error {
+	for _, rules := range [][]PolicyRule{p.Allow, p.Deny} {
+		for _, r := range rules {
+			for _, h := range r.Hosts {
+				if strings.Contains(h, "/") {
+					if _, _, err := net.ParseCIDR(h); err != nil {
+						return err
+					}
+				} else if _, err := path.Match(strings.ToLower(h), ""); err != nil {
+					return fmt.Errorf("Invalid host pattern %q: %w", h, err)
+				}
+			}
+			for _, ports := range r.Ports {
+				if _, _, err := parsePortRange(ports); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Addresses of a destination the policy allows, out of ips.
+// name is the hostname the Client asked for, or empty if it gave an IP address.
+// Also returns why the first address was allowed or refused, for logging.
+func (p *Policy) check(name string, ips []net.IP, port int) (allowed []net.IP, why string) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for i, ip := range ips {
+		ok, reason := p.decide(name, ip, port)
+		if ok {
+			allowed = append(allowed, ip)
+		}
+		if i == 0 {
+			why = reason
+		}
+	}
+	return
+}
+
+// Deny rule that refuses a hostname whatever it resolves to, so that it needn't be looked up.
+func (p *Policy) deniesName(name string, port int) (bool, string) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for i, r := range p.Deny {
+		if r.matches(name, nil, port) {
+			return true, "deny rule " + strconv.Itoa(i)
+		}
+	}
+	return false, ""
+}
+
+func (p *Policy) decide(name string, ip net.IP, port int) (bool, string) {
+	for i, r := range p.Deny {
+		if r.matches(name, ip, port) {
+			return false, "deny rule " + strconv.Itoa(i)
+		}
+	}
+	if len(p.Allow) == 0 {
+		return true, "no allow rules"
+	}
+	for i, r := range p.Allow {
+		if r.matches(name, ip, port) {
+			return true, "allow rule " + strconv.Itoa(i)
+		}
+	}
+	return false, "no allow rule matches"
+}
+
+func (r *PolicyRule) matches(name string, ip net.IP, port int) bool {
+	portMatch := len(r.Ports) == 0
+	for _, ports := range r.Ports {
+		if lo, hi, err := parsePortRange(ports); err == nil && port >= lo && port <= hi {
+			portMatch = true
+			break
+		}
+	}
+	if !portMatch {
+		return false
+	}
+
+	if len(r.Hosts) == 0 {
+		return true
+	}
+	for _, h := range r.Hosts {
+		if strings.Contains(h, "/") {
+			if _, cidr, err := net.ParseCIDR(h); err == nil && cidr.Contains(ip) {
+				return true
+			}
+		} else if hostIP := net.ParseIP(h); hostIP != nil {
+			if hostIP.Equal(ip) {
+				return true
+			}
+		} else if name != "" {
+			if ok, _ := path.Match(strings.ToLower(h), name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Port ("80") or inclusive port range ("8000-8100").
+func parsePortRange(ports string) (lo, hi int, err error) {
+	loStr, hiStr, isRange := strings.Cut(ports, "-")
+	if lo, err = strconv.Atoi(strings.TrimSpace(loStr)); err != nil {
+		return 0, 0, errors.New("Invalid port: " + ports)
+	}
+	hi = lo
+	if isRange {
+		if hi, err = strconv.Atoi(strings.TrimSpace(hiStr)); err != nil {
+			return 0, 0, errors.New("Invalid port range: " + ports)
+		}
+	}
+	if lo < 0 || hi > 0xFFFF || lo > hi {
+		return 0, 0, errors.New("Invalid port range: " + ports)
+	}
+	return lo, hi, nil
+}
@@ -2,126 +2,1328 @@ package protocol_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/RoanBrand/SerialToTCPBridgeProtocol/protocol"
 	"github.com/RoanBrand/goBuffers"
+	"hash/crc32"
 	"io"
 	"net"
-	"strconv"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-const PORT = 3541
-
 // This test setups the following:
 // [TCP Echo Server] <--> [Protocol Gateway] <--> [Fake Serial Wire] <--> [Protocol Client]
-// The Client then writes a single message to the Gateway, waits 1s, then reads any incoming data.
+// The Client then writes a single message to the Gateway, then reads until the echo arrives, for up to 1s.
 // The test compares the sent and received messages, expecting them to be equivalent.
 func TestEcho(t *testing.T) {
-	// start tcp server
-	go startTCPServer(t)
-	time.Sleep(time.Millisecond * 100)
+	testEcho(t, protocol.Dialer{})
+}
 
-	// start protocol gateway server
-	serialTransport := NewFakeTransport()
-	gateway := protocol.Gateway{}
-	go gateway.Listen(&fakeTransportServerInterface{serialTransport})
-	t.Log("Protocol Gateway started")
+// Same as TestEcho, but the Client asks for a sliding window instead of stop-and-wait.
+func TestEchoWindowed(t *testing.T) {
+	testEcho(t, protocol.Dialer{Window: 8})
+}
 
-	// start protocol client
-	endClient, err := protocol.Dial(&fakeTransportClientInterface{serialTransport}, "127.0.0.1:"+strconv.Itoa(PORT))
+// Same as TestEcho, but with two connections multiplexed over one serial link at the same time.
+func TestEchoMultiplexed(t *testing.T) {
+	serverAddr := startTCPServer(t)
+	serialTransport := startGateway(t)
+
+	dialer := protocol.Dialer{Window: 4, Streams: 3}
+	link, err := dialer.NewLink(&fakeTransportClientInterface{serialTransport})
 	if err != nil {
-		t.Fatalf("Protocol client unable to connect to gateway: %v", err)
+		t.Fatalf("Protocol client unable to open link: %v", err)
 	}
-	t.Log("Protocol Client connected to Gateway")
+	defer link.Close()
 
-	message := []byte(
-		`This message will be sent from the client to the gateway,
-		which in turn forwards it to the TCP server we created.
-		The TCP server echoes back what is sent to it, so in the end
-		we expext the gateway to send the same message back to the client.`)
-	messageLength := len(message)
+	conns := make([]net.Conn, 2)
+	for i := range conns {
+		if conns[i], err = link.Dial(serverAddr); err != nil {
+			t.Fatalf("Protocol client unable to connect stream #%d to gateway: %v", i, err)
+		}
+	}
+	t.Log("Protocol Client connected 2 streams to Gateway")
 
-	for i := 1; i <= 5; i++ {
-		nWritten, err := endClient.Write(message)
-		if err != nil {
-			t.Fatalf("Client write fail: %v\n", err)
+	messages := [][]byte{
+		bytes.Repeat([]byte("First stream. "), 10),
+		bytes.Repeat([]byte("Second stream! "), 10),
+	}
+	for i := 1; i <= 3; i++ {
+		for j, conn := range conns {
+			writeMessage(t, conn, messages[j])
 		}
-		if nWritten != messageLength {
-			t.Fatalf("Client write fail: Expected to send %v but sent %v instead\n", messageLength, nWritten)
+		for j, conn := range conns {
+			readMessage(t, conn, messages[j])
 		}
-		t.Logf("Client sent message #%d to Gateway. Now waiting for response.\n", i)
+		t.Logf("Both streams received message #%d. Successful.\n", i)
+	}
+
+	// Closing one stream leaves the other working.
+	conns[0].Close()
+	writeMessage(t, conns[1], messages[1])
+	readMessage(t, conns[1], messages[1])
+}
+
+// The Client opens a UDP socket through the Gateway to a UDP echo server.
+// Datagrams must arrive whole and separate, including ones too large for a single packet.
+func TestEchoUDP(t *testing.T) {
+	serverAddr := startUDPServer(t)
+	serialTransport := startGateway(t)
+
+	endClient, err := protocol.DialUDP(&fakeTransportClientInterface{serialTransport}, serverAddr)
+	if err != nil {
+		t.Fatalf("Protocol client unable to connect to gateway: %v", err)
+	}
+	defer endClient.Close()
 
+	datagrams := [][]byte{
+		[]byte("short datagram"),
+		bytes.Repeat([]byte("0123456789"), 60),
+		[]byte("another one"),
+	}
+	for _, d := range datagrams {
+		writeMessage(t, endClient, d)
+	}
+	for i, d := range datagrams {
+		in := make([]byte, 1024)
 		startTime := time.Now()
-		in := []byte{}
 		for {
-			if time.Now().Sub(startTime) > time.Second {
-				if !bytes.Equal(in, message) {
-					t.Fatalf("Client timed out waiting for correct response. Received so far:\n%s\n%v", string(in), in)
-				}
-			}
-			inByte := make([]byte, 1)
-			nRx, err := endClient.Read(inByte)
+			n, err := endClient.Read(in)
 			if err != nil {
 				t.Fatalf("Client read fail: %v\n", err)
 			}
-			if nRx == 0 {
+			if n > 0 {
+				in = in[:n]
+				break
+			}
+			if time.Now().Sub(startTime) > time.Second {
+				t.Fatalf("Client timed out waiting for datagram #%d", i)
+			}
+		}
+		if !bytes.Equal(in, d) {
+			t.Fatalf("Datagram #%d mismatch. Expected %d bytes, received %d:\n%s", i, len(d), len(in), in)
+		}
+	}
+}
+
+// The Client listens on the Gateway's network. A TCP client connects to it there,
+// and the Client echoes back what it receives on the accepted connection.
+func TestListen(t *testing.T) {
+	// find a free port
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listenAddr := probe.Addr().String()
+	port := probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+
+	serialTransport := startConfiguredGateway(t, &protocol.Gateway{ListenPorts: []int{port}})
+	ln, err := protocol.Listen(&fakeTransportClientInterface{serialTransport}, listenAddr)
+	if err != nil {
+		t.Fatalf("Protocol client unable to listen through gateway: %v", err)
+	}
+	defer ln.Close()
+
+	message := []byte("Hello from the other side of the gateway")
+	reply := make(chan []byte, 1)
+	go func() {
+		conn, err := net.Dial("tcp", listenAddr)
+		if err != nil {
+			t.Errorf("TCP client unable to connect to gateway listener: %v", err)
+			reply <- nil
+			return
+		}
+		defer conn.Close()
+		conn.Write(message)
+		in := make([]byte, len(message))
+		conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+		_, err = io.ReadFull(conn, in)
+		if err != nil {
+			t.Errorf("TCP client read fail: %v", err)
+		}
+		reply <- in
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Listener accept fail: %v", err)
+	}
+	readMessage(t, conn, message)
+	writeMessage(t, conn, message)
+	if in := <-reply; !bytes.Equal(in, message) {
+		t.Fatalf("TCP client expected echo %q, received %q", message, in)
+	}
+
+	ln.Close()
+	if _, err = ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Expected net.ErrClosed from a closed listener, got: %v", err)
+	}
+}
+
+// A Gateway refuses to listen on ports it wasn't configured for.
+func TestListenNotAllowed(t *testing.T) {
+	serialTransport := startGateway(t)
+	_, err := protocol.Listen(&fakeTransportClientInterface{serialTransport}, "127.0.0.1:0")
+	if !errors.Is(err, protocol.ReasonPolicyDenied) {
+		t.Fatalf("Expected listen request to be denied by policy, got: %v", err)
+	}
+}
+
+// A connect with a malformed options block is refused, instead of left for the Client to time out on.
+func TestMalformedConnectOptions(t *testing.T) {
+	serialTransport := startGateway(t)
+	connect := []byte{6, 0x40, 5} // options block claiming 5 bytes it doesn't have
+	serialTransport.Buf1.Write(binary.LittleEndian.AppendUint32(connect, crc32.ChecksumIEEE(connect)))
+
+	reply := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, 7)
+		if _, err := io.ReadFull(&fakeTransportClientInterface{serialTransport}, b); err == nil {
+			reply <- b
+		}
+	}()
+	select {
+	case b := <-reply:
+		if b[1] != 2 || protocol.DisconnectReason(b[2]) != protocol.ReasonProtocolError {
+			t.Fatalf("Expected disconnect with protocol error, got % x", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Gateway did not answer a malformed connect")
+	}
+}
+
+// After too many bad packets in a row the Gateway drops the connection, and the Client can connect again.
+func TestRxErrorsDropLink(t *testing.T) {
+	serverAddr := startTCPServer(t)
+	addr, _ := net.ResolveTCPAddr("tcp", serverAddr)
+	serialTransport := startGateway(t)
+	write := func(packet ...byte) {
+		packet[0] = byte(len(packet) - 1 + 4)
+		serialTransport.Buf1.Write(binary.LittleEndian.AppendUint32(packet, crc32.ChecksumIEEE(packet)))
+	}
+	read := func(n int) []byte {
+		reply := make(chan []byte, 1)
+		go func() {
+			b := make([]byte, n)
+			if _, err := io.ReadFull(&fakeTransportClientInterface{serialTransport}, b); err == nil {
+				reply <- b
+			}
+		}()
+		select {
+		case b := <-reply:
+			return b
+		case <-time.After(time.Second):
+			t.Fatalf("Gateway sent no %d byte packet", n)
+			return nil
+		}
+	}
+
+	write(0, 0, 127, 0, 0, 1, byte(addr.Port), byte(addr.Port>>8)) // legacy connect
+	if b := read(6); b[1] != 1 {
+		t.Fatalf("Expected connack, got % x", b)
+	}
+	for i := 0; i < protocol.DefaultMaxRxErrors; i++ {
+		serialTransport.Buf1.Write([]byte{5, 3, 0, 0, 0, 0}) // publish failing its CRC
+	}
+	if b := read(7); b[1] != 2 || protocol.DisconnectReason(b[2]) != protocol.ReasonLinkFailure {
+		t.Fatalf("Expected disconnect for link failure, got % x", b)
+	}
+
+	endClient, err := (&protocol.Dialer{Timeout: time.Second}).Dial(&fakeTransportClientInterface{serialTransport}, serverAddr)
+	if err != nil {
+		t.Fatalf("Client dial after dropped link fail: %v\n", err)
+	}
+	defer endClient.Close()
+	message := []byte("line is good again")
+	writeMessage(t, endClient, message)
+	readMessage(t, endClient, message)
+}
+
+// The Gateway's reason for refusing a connection is returned by Dial.
+func TestDialRefused(t *testing.T) {
+	// find a port nobody listens on
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := probe.Addr().String()
+	probe.Close()
+
+	serialTransport := startGateway(t)
+	_, err = protocol.Dial(&fakeTransportClientInterface{serialTransport}, closedAddr)
+	if !errors.Is(err, protocol.ReasonConnectionRefused) {
+		t.Fatalf("Expected connection refused, got: %v", err)
+	}
+}
+
+// The Client connects to a literal IPv6 destination through the Gateway.
+func TestEchoIPv6(t *testing.T) {
+	server, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	serverAddr := serveTCPEcho(t, server)
+	serialTransport := startGateway(t)
+
+	endClient, err := protocol.Dial(&fakeTransportClientInterface{serialTransport}, serverAddr)
+	if err != nil {
+		t.Fatalf("Protocol client unable to connect to gateway: %v", err)
+	}
+	defer endClient.Close()
+
+	message := []byte("IPv6 all the way")
+	writeMessage(t, endClient, message)
+	readMessage(t, endClient, message)
+}
+
+// Gateway refuses destinations its policy doesn't allow, also when they are given by hostname.
+func TestPolicy(t *testing.T) {
+	serverAddr := startTCPServer(t)
+	_, serverPort, _ := net.SplitHostPort(serverAddr)
+	policy := &protocol.Policy{
+		Allow: []protocol.PolicyRule{{Hosts: []string{"127.0.0.0/8"}, Ports: []string{serverPort}}},
+		Deny:  []protocol.PolicyRule{{Hosts: []string{"*.invalid"}}},
+	}
+	if err := policy.Validate(); err != nil {
+		t.Fatalf("Policy invalid: %v", err)
+	}
+	if err := (&protocol.Policy{Deny: []protocol.PolicyRule{{Ports: []string{"90-80"}}}}).Validate(); err == nil {
+		t.Fatal("Expected backwards port range to be invalid")
+	}
+
+	serialTransport := startConfiguredGateway(t, &protocol.Gateway{MaxStreams: 4, Policy: policy})
+	link, err := (&protocol.Dialer{Streams: 4}).NewLink(&fakeTransportClientInterface{serialTransport})
+	if err != nil {
+		t.Fatalf("Client link fail: %v\n", err)
+	}
+	defer link.Close()
+
+	for _, address := range []string{"127.0.0.1:1", "10.0.0.1:" + serverPort, "denied.invalid:" + serverPort} {
+		if _, err = link.Dial(address); !errors.Is(err, protocol.ReasonPolicyDenied) {
+			t.Fatalf("Expected %v to be denied, got: %v", address, err)
+		}
+	}
+
+	for _, address := range []string{serverAddr, "localhost:" + serverPort} {
+		endClient, err := link.Dial(address)
+		if err != nil {
+			t.Fatalf("Expected %v to be allowed, got: %v", address, err)
+		}
+		message := []byte("allowed")
+		writeMessage(t, endClient, message)
+		readMessage(t, endClient, message)
+		endClient.Close()
+	}
+}
+
+// Gateway with AuthKeys only serves Clients that authenticate with the right key.
+func TestAuth(t *testing.T) {
+	serverAddr := startTCPServer(t)
+	keys := map[string][]byte{"device-1": []byte("secret key")}
+
+	_, err := protocol.Dial(&fakeTransportClientInterface{startConfiguredGateway(t, &protocol.Gateway{AuthKeys: keys})}, serverAddr)
+	if !errors.Is(err, protocol.ReasonAuthRequired) {
+		t.Fatalf("Expected unauthenticated dial to be refused, got: %v", err)
+	}
+
+	for _, dialer := range []protocol.Dialer{
+		{DeviceID: "device-1", Key: []byte("wrong key")},
+		{DeviceID: "device-2", Key: []byte("secret key")},
+	} {
+		serialTransport := startConfiguredGateway(t, &protocol.Gateway{AuthKeys: keys})
+		if _, err = dialer.NewLink(&fakeTransportClientInterface{serialTransport}); !errors.Is(err, protocol.ReasonAuthFailed) {
+			t.Fatalf("Expected %s to fail authentication, got: %v", dialer.DeviceID, err)
+		}
+	}
+
+	gateway := &protocol.Gateway{AuthKeys: keys}
+	serialTransport := startConfiguredGateway(t, gateway)
+	dialer := protocol.Dialer{DeviceID: "device-1", Key: []byte("secret key"), Streams: 3}
+	link, err := dialer.NewLink(&fakeTransportClientInterface{serialTransport})
+	if err != nil {
+		t.Fatalf("Authenticated link fail: %v\n", err)
+	}
+	defer link.Close()
+	endClient, err := link.Dial(serverAddr)
+	if err != nil {
+		t.Fatalf("Authenticated dial fail: %v\n", err)
+	}
+	message := []byte("it's me")
+	writeMessage(t, endClient, message)
+	readMessage(t, endClient, message)
+
+	// Someone else on the wire can't open connections through the authenticated link.
+	// On stream 2, as the refusal would read as the answer to the next dial, which takes stream 1.
+	addr, _ := net.ResolveTCPAddr("tcp", serverAddr)
+	forged := []byte{0, 0x20, 2, 127, 0, 0, 1, byte(addr.Port), byte(addr.Port >> 8)}
+	forged[0] = byte(len(forged) - 1 + 4)
+	serialTransport.Buf1.Write(binary.LittleEndian.AppendUint32(forged, crc32.ChecksumIEEE(forged)))
+	deadline := time.Now().Add(time.Second)
+	for gateway.Stats().ConnectFailures == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if stats := gateway.Stats(); stats.ConnectFailures != 1 || stats.Streams != 1 {
+		t.Fatalf("Expected forged connect to be refused, got %d failures and %d streams", stats.ConnectFailures, stats.Streams)
+	}
+
+	endClient, err = link.Dial(serverAddr)
+	if err != nil {
+		t.Fatalf("Authenticated dial after forged connect fail: %v\n", err)
+	}
+	writeMessage(t, endClient, message)
+	readMessage(t, endClient, message)
+}
+
+// Encrypted connections echo like any other, and their data never crosses the wire in cleartext.
+func TestEncryption(t *testing.T) {
+	serverAddr := startTCPServer(t)
+	keys := map[string][]byte{"device-1": []byte("secret key")}
+	logger := &recordingLogger{}
+	serialTransport := startConfiguredGateway(t, &protocol.Gateway{AuthKeys: keys, RequireEncryption: true, Logger: logger, Trace: true})
+	wire := &recordingClientInterface{fakeTransportClientInterface: fakeTransportClientInterface{serialTransport}}
+
+	refused := protocol.Dialer{DeviceID: "device-1", Key: []byte("secret key"), Streams: 2, KeepAlive: time.Millisecond * 10}
+	link, err := refused.NewLink(wire)
+	if err != nil {
+		t.Fatalf("Client link fail: %v\n", err)
+	}
+	defer link.Close()
+	if _, err = link.Dial(serverAddr); !errors.Is(err, protocol.ReasonPolicyDenied) {
+		t.Fatalf("Expected unencrypted dial to be refused, got: %v", err)
+	}
+	// Nothing the refused connect asked for is in effect, like keepalive.
+	time.Sleep(time.Millisecond * 100)
+	for _, m := range logger.find("TX") {
+		if strings.Contains(m, " command=ping ") {
+			t.Fatal("Gateway started keepalive for a refused connect")
+		}
+	}
+
+	dialer := protocol.Dialer{DeviceID: "device-1", Key: []byte("secret key"), Encrypt: true, Window: 8}
+	serialTransport = startConfiguredGateway(t, &protocol.Gateway{AuthKeys: keys, RequireEncryption: true})
+	wire = &recordingClientInterface{fakeTransportClientInterface: fakeTransportClientInterface{serialTransport}}
+	endClient, err := dialer.Dial(wire, serverAddr)
+	if err != nil {
+		t.Fatalf("Encrypted dial fail: %v\n", err)
+	}
+	defer endClient.Close()
+	message := bytes.Repeat([]byte("top secret "), 100)
+	writeMessage(t, endClient, message)
+	readMessage(t, endClient, message)
+
+	if bytes.Contains(wire.written(), []byte("top secret")) {
+		t.Fatal("Cleartext sent over the wire")
+	}
+}
+
+// Compressed connections echo like any other, and repetitive data takes much less space on the wire.
+func TestCompression(t *testing.T) {
+	serverAddr := startTCPServer(t)
+	keys := map[string][]byte{"device-1": []byte("secret key")}
+	for _, dialer := range []protocol.Dialer{
+		{Compress: true},
+		{Compress: true, Window: 8, DeviceID: "device-1", Key: []byte("secret key"), Encrypt: true},
+	} {
+		gateway := &protocol.Gateway{}
+		if dialer.Encrypt {
+			gateway.AuthKeys = keys
+		}
+		serialTransport := startConfiguredGateway(t, gateway)
+		endClient, err := dialer.Dial(&fakeTransportClientInterface{serialTransport}, serverAddr)
+		if err != nil {
+			t.Fatalf("Client dial fail: %v\n", err)
+		}
+		message := bytes.Repeat([]byte(`{"sensor": "temperature", "value": 21.5, "unit": "C"}`), 100)
+		for i := 0; i < 3; i++ {
+			writeMessage(t, endClient, message)
+			readMessage(t, endClient, message)
+		}
+
+		stats := endClient.(interface {
+			CompressionStats() protocol.CompressionStats
+		}).CompressionStats()
+		if stats.TxBytes != uint64(len(message)*3) || stats.RxBytes != stats.TxBytes {
+			t.Fatalf("Expected %d bytes each way, got: %+v", len(message)*3, stats)
+		}
+		if stats.TxRatio() > 0.2 || stats.RxRatio() > 0.2 {
+			t.Fatalf("Data not compressed: %+v", stats)
+		}
+		endClient.Close()
+	}
+}
+
+// With COBS framing, the Gateway resyncs at the next packet after line noise.
+func TestCOBSFraming(t *testing.T) {
+	serverAddr := startTCPServer(t)
+	serialTransport := startConfiguredGateway(t, &protocol.Gateway{Framing: protocol.FramingCOBS})
+	dialer := protocol.Dialer{Framing: protocol.FramingCOBS, Window: 4}
+	endClient, err := dialer.Dial(&fakeTransportClientInterface{serialTransport}, serverAddr)
+	if err != nil {
+		t.Fatalf("Client dial fail: %v\n", err)
+	}
+	defer endClient.Close()
+
+	message := bytes.Repeat([]byte{0, 1, 2, 0, 0xFF}, 200)
+	for _, noise := range [][]byte{{20, 3, 1, 2, 3}, {0xFF, 0, 7}, bytes.Repeat([]byte{9}, 600)} {
+		serialTransport.Buf1.Write(noise)
+		writeMessage(t, endClient, message)
+		readMessage(t, endClient, message)
+	}
+}
+
+// Client and Gateway agree on the capabilities both have, and Gateways that don't answer are legacy ones.
+func TestHello(t *testing.T) {
+	serverAddr := startTCPServer(t)
+	serialTransport := startConfiguredGateway(t, &protocol.Gateway{MaxWindow: 1, DisableCompression: true})
+	link, err := (&protocol.Dialer{Window: 8, Compress: true}).NewLink(&fakeTransportClientInterface{serialTransport})
+	if err != nil {
+		t.Fatalf("Client link fail: %v\n", err)
+	}
+	defer link.Close()
+	if link.Version() != 2 {
+		t.Fatalf("Expected protocol version 2, got: %d", link.Version())
+	}
+	caps := link.Capabilities()
+	if caps&(protocol.CapWindow|protocol.CapCompress) != 0 || caps&protocol.CapMultiplex == 0 {
+		t.Fatalf("Unexpected capabilities: %#04x", caps)
+	}
+	endClient, err := link.Dial(serverAddr)
+	if err != nil {
+		t.Fatalf("Client dial fail: %v\n", err)
+	}
+	message := []byte("hello")
+	writeMessage(t, endClient, message)
+	readMessage(t, endClient, message)
+
+	// nobody on the other end of the wire to answer
+	legacyLink, err := (&protocol.Dialer{Window: 8}).NewLink(&fakeTransportClientInterface{NewFakeTransport()})
+	if err != nil {
+		t.Fatalf("Client link fail: %v\n", err)
+	}
+	defer legacyLink.Close()
+	if legacyLink.Version() != 1 || legacyLink.Capabilities() != 0 {
+		t.Fatalf("Expected legacy Gateway, got version %d, capabilities %#04x", legacyLink.Version(), legacyLink.Capabilities())
+	}
+	if _, err = legacyLink.DialUDP(serverAddr); err == nil {
+		t.Fatal("Expected UDP dial to legacy Gateway to fail")
+	}
+
+	// Connects that need options ask first, even if the Dialer didn't need to,
+	// as a legacy Gateway would dial whatever host the options read as.
+	udpAddr := startUDPServer(t)
+	zeroLink, err := (&protocol.Dialer{}).NewLink(&fakeTransportClientInterface{startGateway(t)})
+	if err != nil {
+		t.Fatalf("Client link fail: %v\n", err)
+	}
+	defer zeroLink.Close()
+	if zeroLink.Version() != 0 {
+		t.Fatalf("Expected no hello before dialing, got version %d", zeroLink.Version())
+	}
+	udpClient, err := zeroLink.DialUDP(udpAddr)
+	if err != nil {
+		t.Fatalf("Client UDP dial fail: %v\n", err)
+	}
+	defer udpClient.Close()
+	if zeroLink.Version() != 2 {
+		t.Fatalf("Expected hello before UDP connect, got version %d", zeroLink.Version())
+	}
+	for _, dial := range []func(*protocol.Link) error{
+		func(l *protocol.Link) error { _, err := l.DialUDP(udpAddr); return err },
+		func(l *protocol.Link) error { _, err := l.Dial("[::1]:80"); return err },
+	} {
+		wire := &recordingClientInterface{fakeTransportClientInterface: fakeTransportClientInterface{NewFakeTransport()}}
+		link, err := (&protocol.Dialer{}).NewLink(wire)
+		if err != nil {
+			t.Fatalf("Client link fail: %v\n", err)
+		}
+		if err = dial(link); err == nil {
+			t.Fatal("Expected dial that needs options to fail with a legacy Gateway")
+		}
+		link.Close()
+		(&protocol.Decoder{}).Decode([]protocol.Chunk{{Data: wire.written()}}, func(p protocol.DecodedPacket) {
+			if p.Name != "hello" {
+				t.Fatalf("Expected only hello sent to legacy Gateway, got %s", p.Name)
+			}
+		})
+	}
+}
+
+// Every integrity check works, and FEC corrects corrupted bytes without resends.
+func TestIntegrity(t *testing.T) {
+	serverAddr := startTCPServer(t)
+	message := bytes.Repeat([]byte("integrity "), 60)
+	for _, check := range []protocol.Integrity{protocol.IntegrityCRC16, protocol.IntegrityCRC32C, protocol.IntegrityFEC} {
+		serialTransport := startConfiguredGateway(t, &protocol.Gateway{Framing: protocol.FramingCOBS})
+		dialer := protocol.Dialer{Framing: protocol.FramingCOBS, Integrity: check, Window: 4}
+		link, err := dialer.NewLink(&fakeTransportClientInterface{serialTransport})
+		if err != nil {
+			t.Fatalf("Client link fail: %v\n", err)
+		}
+		defer link.Close()
+		if link.Integrity() != check {
+			t.Fatalf("Expected integrity check %v, got: %v", check, link.Integrity())
+		}
+		endClient, err := link.Dial(serverAddr)
+		if err != nil {
+			t.Fatalf("Client dial fail: %v\n", err)
+		}
+		writeMessage(t, endClient, message)
+		readMessage(t, endClient, message)
+	}
+
+	serialTransport := startConfiguredGateway(t, &protocol.Gateway{})
+	wire := &corruptingClientInterface{fakeTransportClientInterface: fakeTransportClientInterface{serialTransport}}
+	endClient, err := (&protocol.Dialer{Integrity: protocol.IntegrityFEC}).Dial(wire, serverAddr)
+	if err != nil {
+		t.Fatalf("Client dial fail: %v\n", err)
+	}
+	defer endClient.Close()
+	wire.corrupt.Store(true)
+	writeMessage(t, endClient, message)
+	readMessage(t, endClient, message)
+	if wire.publishes() != 3 {
+		t.Fatalf("Expected FEC to correct corrupted packets without resends, but %d publish packets were sent", wire.publishes())
+	}
+}
+
+// Cancelling a Gateway's context disconnects its Client, closes upstream connections and returns.
+func TestGatewayShutdown(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("TCP Server couldn't start listening: " + err.Error())
+	}
+	defer server.Close()
+	upstream := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := server.Accept(); err == nil {
+			upstream <- conn
+		}
+	}()
+
+	serialTransport := NewFakeTransport()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() { served <- new(protocol.Gateway).Serve(ctx, &fakeTransportServerInterface{serialTransport}) }()
+
+	endClient, err := protocol.Dial(&fakeTransportClientInterface{serialTransport}, server.Addr().String())
+	if err != nil {
+		t.Fatalf("Client dial fail: %v\n", err)
+	}
+	defer endClient.Close()
+	conn := <-upstream
+	defer conn.Close()
+
+	cancel()
+	select {
+	case err = <-served:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Expected Serve to return context.Canceled, got: %v", err)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("Serve did not return after its context was cancelled")
+	}
+
+	endClient.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = endClient.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected client to read EOF, got: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected upstream connection to be closed, got: %v", err)
+	}
+}
+
+// Gateways count what happens on their link.
+func TestGatewayStats(t *testing.T) {
+	serverAddr := startTCPServer(t)
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := probe.Addr().String()
+	probe.Close()
+
+	gateway := &protocol.Gateway{}
+	serialTransport := startConfiguredGateway(t, gateway)
+
+	// Stats are read from other goroutines, like the metrics endpoint's, while the link is busy.
+	stopPolling, polled := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(polled)
+		for {
+			select {
+			case <-stopPolling:
+				return
+			case <-time.After(time.Millisecond):
+				gateway.Stats()
+			}
+		}
+	}()
+
+	link, err := (&protocol.Dialer{Streams: 2}).NewLink(&fakeTransportClientInterface{serialTransport})
+	if err != nil {
+		t.Fatalf("Client link fail: %v\n", err)
+	}
+	defer link.Close()
+	endClient, err := link.Dial(serverAddr)
+	if err != nil {
+		t.Fatalf("Client dial fail: %v\n", err)
+	}
+	defer endClient.Close()
+	message := []byte("count me")
+	writeMessage(t, endClient, message)
+	readMessage(t, endClient, message)
+	if _, err = link.Dial(closedAddr); err == nil {
+		t.Fatal("Expected dial to closed port to fail")
+	}
+	serialTransport.Buf1.Write([]byte{6, 3, 1, 2, 3, 4, 5}) // bad CRC
+
+	deadline := time.Now().Add(time.Second)
+	for gateway.Stats().IntegrityFailures == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	close(stopPolling)
+	<-polled
+	stats := gateway.Stats()
+	if stats.ConnectAttempts != 2 || stats.ConnectFailures != 1 {
+		t.Fatalf("Expected 2 connect attempts and 1 failure, got %d and %d", stats.ConnectAttempts, stats.ConnectFailures)
+	}
+	if stats.BytesUp != uint64(len(message)) || stats.BytesDown != uint64(len(message)) {
+		t.Fatalf("Expected %d bytes up and down, got %d and %d", len(message), stats.BytesUp, stats.BytesDown)
+	}
+	if stats.FramesSent == 0 || stats.FramesReceived == 0 || stats.IntegrityFailures != 1 {
+		t.Fatalf("Unexpected frame counts: %+v", stats)
+	}
+	if stats.State != protocol.Connected || stats.Streams != 1 {
+		t.Fatalf("Expected 1 connected stream, got state %d with %d streams", stats.State, stats.Streams)
+	}
+}
+
+// Gateway log messages carry its name and session, and tracing decodes every packet.
+func TestLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	gateway := &protocol.Gateway{Name: "test gateway", Logger: logger, Trace: true}
+	serialTransport := startConfiguredGateway(t, gateway)
+	endClient, err := protocol.Dial(&fakeTransportClientInterface{serialTransport}, startTCPServer(t))
+	if err != nil {
+		t.Fatalf("Client dial fail: %v\n", err)
+	}
+	message := []byte("trace me")
+	writeMessage(t, endClient, message)
+	readMessage(t, endClient, message)
+	endClient.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for len(logger.find("TX")) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if len(logger.find("TX")) < 3 {
+		t.Fatal("Expected connack, publish and ack TX traces")
+	}
+	for _, want := range []string{"command=connect", "command=publish", "seq=0", "check=CRC32", "ok=true"} {
+		found := false
+		for _, m := range logger.find("RX") {
+			found = found || strings.Contains(m, " "+want+" ")
+		}
+		if !found {
+			t.Fatalf("No RX trace with %s in %q", want, logger.find("RX"))
+		}
+	}
+	for _, m := range logger.messages() {
+		if !strings.Contains(m, " gateway=test gateway ") || !strings.Contains(m, " session=") {
+			t.Fatalf("Expected gateway and session attributes in %q", m)
+		}
+	}
+}
+
+// On a windowed stream, the trace shows the sequence numbers of publish and acknowledge packets.
+func TestTraceWindowed(t *testing.T) {
+	logger := &recordingLogger{}
+	serialTransport := startConfiguredGateway(t, &protocol.Gateway{Logger: logger, Trace: true})
+	dialer := protocol.Dialer{Window: 8}
+	endClient, err := dialer.Dial(&fakeTransportClientInterface{serialTransport}, startTCPServer(t))
+	if err != nil {
+		t.Fatalf("Client dial fail: %v\n", err)
+	}
+	defer endClient.Close()
+	for i := 0; i < 3; i++ {
+		message := []byte(fmt.Sprintf("trace me #%d", i))
+		writeMessage(t, endClient, message)
+		readMessage(t, endClient, message)
+	}
+
+	traced := func(direction, command string) bool {
+		for _, m := range logger.find(direction) {
+			if strings.Contains(m, " command="+command+" ") && strings.Contains(m, " seq=2 ") {
+				return true
+			}
+		}
+		return false
+	}
+	deadline := time.Now().Add(time.Second)
+	for !traced("TX", "acknowledge") && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !traced("RX", "publish") || !traced("TX", "acknowledge") {
+		t.Fatalf("Expected third publish and its ack traced with seq=2, got %q", logger.messages())
+	}
+}
+
+// Everything crossing the wire is recorded to pcapng, in a new file whenever the last one is large enough.
+func TestCapture(t *testing.T) {
+	capturePath := filepath.Join(t.TempDir(), "link.pcapng")
+	capture := &protocol.Capture{Path: capturePath, MaxSize: 512}
+	serialTransport := NewFakeTransport()
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- (&protocol.Gateway{Capture: capture}).Serve(ctx, &fakeTransportServerInterface{serialTransport})
+	}()
+
+	endClient, err := protocol.Dial(&fakeTransportClientInterface{serialTransport}, startTCPServer(t))
+	if err != nil {
+		t.Fatalf("Client dial fail: %v\n", err)
+	}
+	message := []byte("capture me")
+	writeMessage(t, endClient, message)
+	readMessage(t, endClient, message)
+	cancel()
+	<-served
+	endClient.Close()
+	capture.Close()
+
+	files, _ := filepath.Glob(strings.TrimSuffix(capturePath, ".pcapng") + "-*.pcapng")
+	if len(files) == 0 {
+		t.Fatal("Expected capture file to be rotated")
+	}
+	var rawBytes [3]int // by direction
+	var comments []string
+	var received []protocol.Chunk
+	for _, file := range append(files, capturePath) {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rx, _, err := protocol.ReadCapture(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("Reading %s: %v", file, err)
+		}
+		received = append(received, rx...)
+
+		blocks := readPCAPNG(t, file)
+		if len(blocks) < 3 || blocks[0].blockType != 0x0A0D0D0A || blocks[1].blockType != 1 || blocks[2].blockType != 1 {
+			t.Fatalf("Expected %s to start with a section header and 2 interfaces", file)
+		}
+		for _, b := range blocks {
+			if b.blockType != 6 {
 				continue
 			}
-			in = append(in, inByte...)
-			if bytes.Equal(in, message) {
-				break
+			iface := binary.LittleEndian.Uint32(b.body)
+			length := binary.LittleEndian.Uint32(b.body[12:])
+			direction := binary.LittleEndian.Uint32(b.option(2))
+			if iface == 0 {
+				rawBytes[direction] += int(length)
+			} else {
+				comments = append(comments, string(b.option(1)))
 			}
 		}
+	}
+	if rawBytes[1] == 0 || rawBytes[2] == 0 {
+		t.Fatalf("Expected raw bytes both ways, got %d in and %d out", rawBytes[1], rawBytes[2])
+	}
+	for _, want := range []string{"command=connect", "command=connack", "command=publish", "command=acknowledge", "command=disconnect"} {
+		found := false
+		for _, c := range comments {
+			found = found || strings.HasPrefix(c, want+" ")
+		}
+		if !found {
+			t.Fatalf("No %s packet captured in %q", want, comments)
+		}
+	}
+
+	// What the Gateway received decodes to the same packets.
+	published := false
+	(&protocol.Decoder{}).Decode(received, func(p protocol.DecodedPacket) {
+		if p.Result != protocol.DecodeOK {
+			t.Fatalf("Expected captured %s packet to decode, got %v", p.Name, p.Result)
+		}
+		published = published || p.Name == "publish" && bytes.Equal(p.Payload, message)
+	})
+	if !published {
+		t.Fatal("Expected message in a captured publish packet")
+	}
+}
+
+// Decoding what a Gateway received offline finds the same packets, after skipping garbage,
+// and follows the integrity check asked for in the hello.
+func TestDecoder(t *testing.T) {
+	serialTransport := startGateway(t)
+	wire := &recordingClientInterface{fakeTransportClientInterface: fakeTransportClientInterface{serialTransport}}
+	endClient, err := (&protocol.Dialer{Integrity: protocol.IntegrityCRC16}).Dial(wire, startTCPServer(t))
+	if err != nil {
+		t.Fatalf("Client dial fail: %v\n", err)
+	}
+	defer endClient.Close()
+	message := []byte("decode me")
+	writeMessage(t, endClient, message)
+	readMessage(t, endClient, message)
+
+	noise := []byte{3, 0xFF, 0xFF, 0xFF}
+	stream := append(append(noise, wire.written()...), 10, 3)
+	var decoded []protocol.DecodedPacket
+	(&protocol.Decoder{}).Decode([]protocol.Chunk{{Data: stream}}, func(p protocol.DecodedPacket) {
+		decoded = append(decoded, p)
+	})
+	if len(decoded) < 5 {
+		t.Fatalf("Expected at least 5 results, got %d", len(decoded))
+	}
+	if p := decoded[0]; p.Result != protocol.DecodeBadCheck || !bytes.Equal(p.Raw, noise) {
+		t.Fatalf("Expected noise to fail its check, got %v with %v", p.Result, p.Raw)
+	}
+	if p := decoded[1]; p.Result != protocol.DecodeOK || p.Name != "hello" || p.Offset != int64(len(noise)) {
+		t.Fatalf("Expected hello at offset %d, got %s at %d (%v)", len(noise), p.Name, p.Offset, p.Result)
+	}
+	if p := decoded[len(decoded)-1]; p.Result != protocol.DecodeTruncated {
+		t.Fatalf("Expected truncated packet at the end, got %v", p.Result)
+	}
+	published := false
+	for _, p := range decoded[2 : len(decoded)-1] {
+		if p.Result != protocol.DecodeOK || p.Check != protocol.IntegrityCRC16 {
+			t.Fatalf("Expected %s to pass a CRC16 check, got %v with %v", p.Name, p.Result, p.Check)
+		}
+		published = published || p.Name == "publish" && bytes.Equal(p.Payload, message)
+	}
+	if !published {
+		t.Fatal("Expected message in a publish packet")
+	}
+}
+
+// Both directions of a Gateway's capture decode together, in the order they crossed the wire,
+// with the integrity check the Gateway granted.
+func TestDecodeLink(t *testing.T) {
+	capturePath := filepath.Join(t.TempDir(), "link.pcapng")
+	capture := &protocol.Capture{Path: capturePath}
+	serialTransport := startConfiguredGateway(t, &protocol.Gateway{Capture: capture})
+	endClient, err := (&protocol.Dialer{Integrity: protocol.IntegrityCRC16}).Dial(&fakeTransportClientInterface{serialTransport}, startTCPServer(t))
+	if err != nil {
+		t.Fatalf("Client dial fail: %v\n", err)
+	}
+	message := []byte("decode both ways")
+	writeMessage(t, endClient, message)
+	readMessage(t, endClient, message)
+	endClient.Close()
+	capture.Close()
+
+	data, err := os.ReadFile(capturePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !protocol.IsCapture(data) || protocol.IsCapture([]byte{10, 3, 0, 1, 2, 3}) {
+		t.Fatal("Expected the capture, and only the capture, to be told from raw bytes")
+	}
+	received, sent, err := protocol.ReadCapture(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	var last time.Time
+	(&protocol.Decoder{}).DecodeLink(received, sent, func(isSent bool, p protocol.DecodedPacket) {
+		if p.Result != protocol.DecodeOK {
+			t.Fatalf("Expected captured %s packet to decode, got %v", p.Name, p.Result)
+		}
+		if p.Time.Before(last) {
+			t.Fatalf("%s packet at %v decoded after one at %v", p.Name, p.Time, last)
+		}
+		last = p.Time
+		if p.Name != "hello" && p.Check != protocol.IntegrityCRC16 {
+			t.Fatalf("Expected %s to pass a CRC16 check, got %v", p.Name, p.Check)
+		}
+		direction := "RX"
+		if isSent {
+			direction = "TX"
+		}
+		names = append(names, direction+" "+p.Name)
+	})
+	if len(names) < 4 || names[0] != "RX hello" || names[1] != "TX hello" || names[2] != "RX connect" || names[3] != "TX connack" {
+		t.Fatalf("Expected hello both ways, then connect and connack, got %q", names)
+	}
+}
+
+// A Tap in the middle of the wire relays both directions unchanged, and logs the packets in each.
+// [Protocol Client] <--> [Fake Serial Wire] <--> [Tap] <--> [Fake Serial Wire] <--> [Protocol Gateway]
+func TestTap(t *testing.T) {
+	clientWire, gatewayWire := NewFakeTransport(), startGateway(t)
+	logger := &recordingLogger{}
+	tap := &protocol.Tap{NameA: "client", NameB: "gateway", Logger: logger}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- tap.Serve(ctx, &fakeTransportServerInterface{clientWire}, &fakeTransportClientInterface{gatewayWire})
+	}()
+
+	endClient, err := protocol.Dial(&fakeTransportClientInterface{clientWire}, startTCPServer(t))
+	if err != nil {
+		t.Fatalf("Client dial through tap fail: %v\n", err)
+	}
+	message := []byte("tapped")
+	writeMessage(t, endClient, message)
+	readMessage(t, endClient, message)
+
+	for _, want := range []struct{ direction, attr string }{
+		{"client->gateway", "command=connect"},
+		{"client->gateway", "command=publish"},
+		{"gateway->client", "command=connack"},
+		{"gateway->client", "command=publish"},
+	} {
+		// Bytes are relayed before they are decoded, so the last packets may still be on their way to the log.
+		found := false
+		for deadline := time.Now().Add(time.Second); !found && time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+			for _, m := range logger.find(want.direction) {
+				found = found || strings.Contains(m, " "+want.attr+" ")
+			}
+		}
+		if !found {
+			t.Fatalf("No %s packet logged with %s in %q", want.direction, want.attr, logger.messages())
+		}
+	}
+
+	cancel()
+	select {
+	case err = <-served:
+		if err != context.Canceled {
+			t.Fatalf("Expected Serve to return context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Tap did not stop")
+	}
+}
+
+// Dials give up when their context is done, or their timeout expires with no answer from a Gateway.
+func TestDialContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := (&protocol.Dialer{}).DialContext(ctx, &fakeTransportClientInterface{NewFakeTransport()}, "127.0.0.1:80")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected canceled dial, got: %v", err)
+	}
+
+	// nobody on the other end of the wire
+	startTime := time.Now()
+	dialer := protocol.Dialer{Timeout: time.Millisecond * 200}
+	_, err = dialer.Dial(&fakeTransportClientInterface{NewFakeTransport()}, "127.0.0.1:80")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected dial to time out, got: %v", err)
+	}
+	if elapsed := time.Now().Sub(startTime); elapsed > time.Second {
+		t.Fatalf("Dial took %v to time out", elapsed)
+	}
+}
+
+// Keepalive keeps an idle link up while the Gateway answers, and drops it once the wire goes dead.
+func TestKeepAlive(t *testing.T) {
+	serverAddr := startTCPServer(t)
+	serialTransport := NewFakeTransport()
+	var cut atomic.Bool
+	go new(protocol.Gateway).Listen(&cuttableServerInterface{fakeTransportServerInterface{serialTransport}, &cut})
+
+	dialer := protocol.Dialer{KeepAlive: time.Millisecond * 50, KeepAliveMisses: 2}
+	endClient, err := dialer.Dial(&cuttableClientInterface{fakeTransportClientInterface{serialTransport}, &cut}, serverAddr)
+	if err != nil {
+		t.Fatalf("Client dial fail: %v\n", err)
+	}
+	defer endClient.Close()
+
+	time.Sleep(time.Millisecond * 300)
+	message := []byte("still here")
+	writeMessage(t, endClient, message)
+	readMessage(t, endClient, message)
+
+	cut.Store(true)
+	endClient.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = endClient.Read(make([]byte, 1))
+	if !errors.Is(err, protocol.ReasonKeepAliveTimeout) {
+		t.Fatalf("Expected keepalive timeout, got: %v", err)
+	}
+}
+
+// Link timings are configurable, so a short ack timeout drops a dead link long before the default would.
+func TestTimings(t *testing.T) {
+	if _, err := (&protocol.Dialer{Timings: protocol.Timings{AckTimeout: -1}}).NewLink(&fakeTransportClientInterface{NewFakeTransport()}); err == nil {
+		t.Fatal("Expected negative ack timeout to be refused")
+	}
+	gateway := &protocol.Gateway{Timings: protocol.Timings{RxBufferSize: -1}}
+	if err := gateway.Serve(context.Background(), &fakeTransportServerInterface{NewFakeTransport()}); err == nil {
+		t.Fatal("Expected negative buffer size to be refused")
+	}
+
+	serverAddr := startTCPServer(t)
+	serialTransport := NewFakeTransport()
+	var cut atomic.Bool
+	go new(protocol.Gateway).Listen(&cuttableServerInterface{fakeTransportServerInterface{serialTransport}, &cut})
+
+	dialer := protocol.Dialer{Timings: protocol.Timings{AckTimeout: time.Millisecond * 20, MaxRetries: 2, RxBufferSize: 64}}
+	endClient, err := dialer.Dial(&cuttableClientInterface{fakeTransportClientInterface{serialTransport}, &cut}, serverAddr)
+	if err != nil {
+		t.Fatalf("Client dial fail: %v\n", err)
+	}
+	defer endClient.Close()
+	message := []byte("timed")
+	writeMessage(t, endClient, message)
+	readMessage(t, endClient, message)
+
+	cut.Store(true)
+	endClient.Write(message)
+	endClient.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+	_, err = endClient.Read(make([]byte, 1))
+	if !errors.Is(err, protocol.ReasonLinkFailure) {
+		t.Fatalf("Expected link failure after 2 retries, got: %v", err)
+	}
+}
+
+// Closing a connection tells the Gateway, so it hangs up upstream and frees the channel for the next one.
+func TestCloseTellsGateway(t *testing.T) {
+	gateway := &protocol.Gateway{}
+	serialTransport := startConfiguredGateway(t, gateway)
+	endClient, err := protocol.Dial(&fakeTransportClientInterface{serialTransport}, startTCPServer(t))
+	if err != nil {
+		t.Fatalf("Client dial fail: %v\n", err)
+	}
+	message := []byte("bye")
+	writeMessage(t, endClient, message)
+	readMessage(t, endClient, message)
+	endClient.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for stats := gateway.Stats(); (stats.Streams != 0 || stats.State != protocol.Disconnected) && time.Now().Before(deadline); stats = gateway.Stats() {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if stats := gateway.Stats(); stats.Streams != 0 || stats.State != protocol.Disconnected {
+		t.Fatalf("Expected Gateway to drop the closed connection, got state %d with %d streams", stats.State, stats.Streams)
+	}
+}
+
+func TestConnSemantics(t *testing.T) {
+	serverAddr := startTCPServer(t)
+	serialTransport := startGateway(t)
+	endClient, err := (&protocol.Dialer{Window: 8}).Dial(&fakeTransportClientInterface{serialTransport}, serverAddr)
+	if err != nil {
+		t.Fatalf("Client dial fail: %v\n", err)
+	}
+	defer endClient.Close()
+
+	if endClient.RemoteAddr().String() != serverAddr {
+		t.Fatalf("Expected remote address %v, got: %v", serverAddr, endClient.RemoteAddr())
+	}
+	if endClient.LocalAddr() == nil {
+		t.Fatal("No local address")
+	}
+
+	// nothing to read yet
+	endClient.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	_, err = endClient.Read(make([]byte, 10))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("Expected read to time out, got: %v", err)
+	}
+	endClient.SetReadDeadline(time.Time{})
+
+	// many packets worth
+	message := bytes.Repeat([]byte("0123456789abcdef"), 256)
+	writeMessage(t, endClient, message)
+	readMessage(t, endClient, message)
+
+	// blocked read wakes up for data
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		endClient.Write([]byte("late"))
+	}()
+	in := make([]byte, 100)
+	endClient.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := endClient.Read(in)
+	if err != nil || n == 0 {
+		t.Fatalf("Blocked read failed: %v", err)
+	}
+}
+
+func testEcho(t *testing.T, dialer protocol.Dialer) {
+	// start tcp server
+	serverAddr := startTCPServer(t)
+
+	// start protocol gateway server
+	serialTransport := startGateway(t)
+
+	// start protocol client
+	endClient, err := dialer.Dial(&fakeTransportClientInterface{serialTransport}, serverAddr)
+	if err != nil {
+		t.Fatalf("Protocol client unable to connect to gateway: %v", err)
+	}
+	t.Log("Protocol Client connected to Gateway")
+
+	message := []byte(
+		`This message will be sent from the client to the gateway,
+		which in turn forwards it to the TCP server we created.
+		The TCP server echoes back what is sent to it, so in the end
+		we expext the gateway to send the same message back to the client.`)
+
+	for i := 1; i <= 5; i++ {
+		writeMessage(t, endClient, message)
+		t.Logf("Client sent message #%d to Gateway. Now waiting for response.\n", i)
+		readMessage(t, endClient, message)
 		t.Logf("Client received message #%d. Successful.\n", i)
 	}
 }
 
-func startTCPServer(t *testing.T) {
-	server, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(PORT))
+// Start a protocol Gateway on a new fake serial wire.
+func startGateway(t *testing.T) *fakeTransport {
+	return startConfiguredGateway(t, &protocol.Gateway{})
+}
+
+func startConfiguredGateway(t *testing.T, gateway *protocol.Gateway) *fakeTransport {
+	serialTransport := NewFakeTransport()
+	go gateway.Listen(&fakeTransportServerInterface{serialTransport})
+	t.Log("Protocol Gateway started")
+	return serialTransport
+}
+
+func writeMessage(t *testing.T, conn net.Conn, message []byte) {
+	nWritten, err := conn.Write(message)
+	if err != nil {
+		t.Fatalf("Client write fail: %v\n", err)
+	}
+	if nWritten != len(message) {
+		t.Fatalf("Client write fail: Expected to send %v but sent %v instead\n", len(message), nWritten)
+	}
+}
+
+// Read from conn until message is received, failing the test if it isn't within 1s.
+func readMessage(t *testing.T, conn net.Conn, message []byte) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	in := make([]byte, len(message))
+	n, err := io.ReadFull(conn, in)
+	if err != nil {
+		t.Fatalf("Client timed out waiting for correct response (%v). Received so far:\n%s\n%v", err, string(in[:n]), in[:n])
+	}
+	if !bytes.Equal(in, message) {
+		t.Fatalf("Client received wrong response:\n%s\n%v", string(in), in)
+	}
+}
+
+// Start a TCP echo server for the duration of the test. Returns its address.
+func startTCPServer(t *testing.T) string {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
 	if server == nil {
 		t.Fatal("TCP Server couldn't start listening: " + err.Error())
 	}
-	defer server.Close()
-	conns := clientConns(t, server)
-	t.Log("TCP Server started")
-	for {
-		go handleConn(t, <-conns)
-	}
+	return serveTCPEcho(t, server)
 }
 
-func clientConns(t *testing.T, listener net.Listener) chan net.Conn {
-	ch := make(chan net.Conn)
-	i := 0
+func serveTCPEcho(t *testing.T, server net.Listener) string {
+	// Connections still open when the test ends are closed, and waited for, so nothing logs after the test.
+	var served sync.WaitGroup
+	var connsLock sync.Mutex
+	var conns []net.Conn
+	stopped := false
+	closing := func() bool {
+		connsLock.Lock()
+		defer connsLock.Unlock()
+		return stopped
+	}
+	t.Cleanup(func() {
+		connsLock.Lock()
+		stopped = true
+		server.Close()
+		for _, c := range conns {
+			c.Close()
+		}
+		connsLock.Unlock()
+		served.Wait()
+	})
+
+	t.Log("TCP Server started")
+	served.Add(1)
 	go func() {
+		defer served.Done()
+		i := 0
 		for {
-			client, err := listener.Accept()
+			client, err := server.Accept()
 			if client == nil {
-				t.Errorf("TCP Server couldn't accept: %v\n", err)
-				continue
+				if !closing() {
+					t.Logf("TCP Server stopped accepting: %v\n", err)
+				}
+				return
 			}
+			connsLock.Lock()
+			if stopped {
+				connsLock.Unlock()
+				client.Close()
+				return
+			}
+			conns = append(conns, client)
+			served.Add(1)
+			connsLock.Unlock()
 			i++
 			t.Logf("TCP Server accepted conn: #%d %v <-> %v\n", i, client.LocalAddr(), client.RemoteAddr())
-			ch <- client
+			go func() {
+				defer served.Done()
+				handleConn(t, client, closing)
+			}()
+		}
+	}()
+	return server.Addr().String()
+}
+
+// Start a UDP echo server for the duration of the test. Returns its address.
+func startUDPServer(t *testing.T) string {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("UDP Server couldn't start listening: " + err.Error())
+	}
+	t.Cleanup(func() { server.Close() })
+	go func() {
+		msg := make([]byte, 2048)
+		for {
+			n, addr, err := server.ReadFrom(msg)
+			if err != nil {
+				return
+			}
+			server.WriteTo(msg[:n], addr)
 		}
 	}()
-	return ch
+	return server.LocalAddr().String()
 }
 
-func handleConn(t *testing.T, client net.Conn) {
+func handleConn(t *testing.T, client net.Conn, closing func() bool) {
 	defer client.Close()
 	msg := make([]byte, 1024)
 	for {
 		n, err := client.Read(msg)
+		if closing() {
+			return
+		}
 		if err == io.EOF {
 			t.Logf("TCP Server: Received EOF (%d bytes ignored)\n", n)
 			return
 		} else if err != nil {
-			t.Fatalf("TCP Server: Error reading from client: %v\n", err)
+			t.Errorf("TCP Server: Error reading from client: %v\n", err)
+			return
 		}
 		n, err = client.Write(msg[:n])
-		if err != nil {
-			t.Fatalf("TCP Server: Error writing to client: %v\n", err)
+		if err != nil && !closing() {
+			t.Errorf("TCP Server: Error writing to client: %v\n", err)
+			return
 		}
 	}
 }
@@ -174,3 +1376,149 @@ func (si *fakeTransportServerInterface) Write(p []byte) (n int, err error) {
 	n, err = si.Buf2.Write(p)
 	return
 }
+
+// Interfaces to the fake transport that silently drop everything written once cut.
+type cuttableClientInterface struct {
+	fakeTransportClientInterface
+	cut *atomic.Bool
+}
+
+func (ci *cuttableClientInterface) Write(p []byte) (n int, err error) {
+	if ci.cut.Load() {
+		return len(p), nil
+	}
+	return ci.fakeTransportClientInterface.Write(p)
+}
+
+type cuttableServerInterface struct {
+	fakeTransportServerInterface
+	cut *atomic.Bool
+}
+
+func (si *cuttableServerInterface) Write(p []byte) (n int, err error) {
+	if si.cut.Load() {
+		return len(p), nil
+	}
+	return si.fakeTransportServerInterface.Write(p)
+}
+
+// Client interface to the fake transport that corrupts 3 bytes of every packet it sends once told to,
+// leaving the length and command bytes alone.
+type corruptingClientInterface struct {
+	fakeTransportClientInterface
+	corrupt   atomic.Bool
+	published atomic.Int32 // Publish packets sent while corrupting.
+}
+
+func (ci *corruptingClientInterface) Write(p []byte) (n int, err error) {
+	if ci.corrupt.Load() && len(p) > 8 {
+		if p[1]&0x0F == 3 {
+			ci.published.Add(1)
+		}
+		p = append([]byte(nil), p...)
+		for _, i := range []int{2, len(p) / 2, len(p) - 1} {
+			p[i] ^= 0xA5
+		}
+	}
+	return ci.fakeTransportClientInterface.Write(p)
+}
+
+func (ci *corruptingClientInterface) publishes() int {
+	return int(ci.published.Load())
+}
+
+// Client interface to the fake transport that keeps a copy of everything the Client sends.
+type recordingClientInterface struct {
+	fakeTransportClientInterface
+	lock sync.Mutex
+	sent []byte
+}
+
+func (ci *recordingClientInterface) Write(p []byte) (n int, err error) {
+	ci.lock.Lock()
+	ci.sent = append(ci.sent, p...)
+	ci.lock.Unlock()
+	return ci.fakeTransportClientInterface.Write(p)
+}
+
+func (ci *recordingClientInterface) written() []byte {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+	return append([]byte(nil), ci.sent...)
+}
+
+// Logger keeping messages as "LEVEL msg key=value ... ", for tests to look through.
+type recordingLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *recordingLogger) Debug(msg string, args ...any) { l.record("DEBUG", msg, args) }
+func (l *recordingLogger) Info(msg string, args ...any)  { l.record("INFO", msg, args) }
+func (l *recordingLogger) Warn(msg string, args ...any)  { l.record("WARN", msg, args) }
+func (l *recordingLogger) Error(msg string, args ...any) { l.record("ERROR", msg, args) }
+
+func (l *recordingLogger) record(level, msg string, args []any) {
+	m := level + " " + msg + " "
+	for i := 0; i+1 < len(args); i += 2 {
+		m += fmt.Sprintf("%v=%v ", args[i], args[i+1])
+	}
+	l.mu.Lock()
+	l.msgs = append(l.msgs, m)
+	l.mu.Unlock()
+}
+
+func (l *recordingLogger) messages() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.msgs...)
+}
+
+// Messages with msg.
+func (l *recordingLogger) find(msg string) (found []string) {
+	for _, m := range l.messages() {
+		if strings.Contains(m, " "+msg+" ") {
+			found = append(found, m)
+		}
+	}
+	return found
+}
+
+type pcapngBlock struct {
+	blockType uint32
+	body      []byte
+}
+
+// Blocks of a little endian pcapng file.
+func readPCAPNG(t *testing.T, path string) (blocks []pcapngBlock) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(data) >= 12 {
+		total := binary.LittleEndian.Uint32(data[4:])
+		if total < 12 || int(total) > len(data) || binary.LittleEndian.Uint32(data[total-4:]) != total {
+			t.Fatalf("Bad pcapng block length %d", total)
+		}
+		blocks = append(blocks, pcapngBlock{binary.LittleEndian.Uint32(data), data[8 : total-4]})
+		data = data[total:]
+	}
+	if len(data) != 0 {
+		t.Fatalf("%d bytes left over after the last pcapng block", len(data))
+	}
+	return blocks
+}
+
+// Value of an option of an enhanced packet block.
+func (b pcapngBlock) option(code uint16) []byte {
+	length := binary.LittleEndian.Uint32(b.body[12:])
+	opts := b.body[20+(length+3)/4*4:]
+	for len(opts) >= 4 {
+		c, l := binary.LittleEndian.Uint16(opts), int(binary.LittleEndian.Uint16(opts[2:]))
+		if c == code {
+			return opts[4 : 4+l]
+		}
+		opts = opts[4+(l+3)/4*4:]
+	}
+	return nil
+}
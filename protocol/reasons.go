@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// Why a connection was ended or refused.
+// Carried as the only payload byte of a disconnect packet, and returned as an error by
+// Dial and client reads, so it can be checked with errors.Is(err, protocol.ReasonConnectionRefused).
+// Legacy partners send disconnect without a payload, which is ReasonUnspecified.
+type DisconnectReason byte
+
+const (
+	ReasonUnspecified       DisconnectReason = iota // No reason given.
+	ReasonClosed                                    // Protocol partner closed the connection.
+	ReasonConnectionRefused                         // Server refused the connection.
+	ReasonDNSFailure                                // Server hostname could not be resolved.
+	ReasonTimeout                                   // Server did not answer in time.
+	ReasonUnreachable                               // No route to the server.
+	ReasonPolicyDenied                              // Gateway does not allow the destination.
+	ReasonUpstreamClosed                            // Server closed the connection.
+	ReasonUpstreamError                             // Connection to the server failed.
+	ReasonLinkFailure                               // Serial link failed: too many retries or RX timeouts.
+	ReasonProtocolError                             // Invalid or unsupported request.
+	ReasonNoResources                               // No free stream or backlog space for the connection.
+	ReasonKeepAliveTimeout                          // Protocol partner stopped answering keepalive pings.
+	ReasonAuthRequired                              // Gateway only accepts connects from authenticated Clients.
+	ReasonAuthFailed                                // Unknown device ID, or wrong key.
+	ReasonDecryptFailed                             // Encrypted publish failed authentication.
+)
+
+var reasonText = []string{
+	"disconnected",
+	"connection closed by protocol partner",
+	"connection refused by server",
+	"server hostname lookup failed",
+	"timed out connecting to server",
+	"server unreachable",
+	"destination denied by gateway policy",
+	"server closed connection",
+	"error on connection to server",
+	"serial link failure",
+	"protocol error",
+	"no resources for connection",
+	"serial link keepalive timed out",
+	"gateway requires authentication",
+	"authentication failed",
+	"encrypted data failed authentication",
+}
+
+func (r DisconnectReason) Error() string {
+	if int(r) < len(reasonText) {
+		return reasonText[r]
+	}
+	return "disconnected (reason " + strconv.Itoa(int(r)) + ")"
+}
+
+// Timeout reports whether the reason is a timeout, to satisfy net.Error.
+func (r DisconnectReason) Timeout() bool {
+	return r == ReasonTimeout
+}
+
+// Temporary is part of net.Error.
+func (r DisconnectReason) Temporary() bool {
+	return r == ReasonTimeout || r == ReasonNoResources
+}
+
+// Disconnect packet giving a reason.
+func disconnectPacket(reason DisconnectReason) Packet {
+	return Packet{command: disconnect, payload: []byte{byte(reason)}}
+}
+
+// Reason a received disconnect packet gives.
+func disconnectReason(p *Packet) DisconnectReason {
+	if len(p.payload) == 0 {
+		return ReasonUnspecified
+	}
+	return DisconnectReason(p.payload[0])
+}
+
+// Reason to report to the protocol partner for an error on the connection to the server.
+func upstreamReason(err error) DisconnectReason {
+	var reason DisconnectReason
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &reason):
+		return reason
+	case errors.Is(err, io.EOF):
+		return ReasonUpstreamClosed
+	case errors.As(err, &dnsErr):
+		return ReasonDNSFailure
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ReasonConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return ReasonUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ReasonTimeout
+	}
+	return ReasonUpstreamError
+}
@@ -0,0 +1,56 @@
+package protocol
+
+import "sync/atomic"
+
+// Counters of a link. They aren't reset when a Gateway serves a new link, so they suit monitoring.
+type linkStats struct {
+	framesSent        atomic.Uint64
+	framesReceived    atomic.Uint64
+	integrityFailures atomic.Uint64
+	rxTimeouts        atomic.Uint64
+	retransmits       atomic.Uint64
+	retriesExhausted  atomic.Uint64
+	bytesUp           atomic.Uint64
+	bytesDown         atomic.Uint64
+	connectAttempts   atomic.Uint64
+	connectFailures   atomic.Uint64
+}
+
+// Statistics of a Gateway, counted since it was created.
+type GatewayStats struct {
+	FramesSent        uint64 // Packets written to the serial link.
+	FramesReceived    uint64 // Packets received that passed their integrity check.
+	IntegrityFailures uint64 // Packets received that failed their integrity check (CRC).
+	RxTimeouts        uint64 // Packets that stopped arriving halfway through.
+	Retransmits       uint64 // Publish packets sent again, for lack of an Ack.
+	RetriesExhausted  uint64 // Streams dropped because the Client stopped acknowledging.
+	BytesUp           uint64 // Written to upstream servers on behalf of the Client.
+	BytesDown         uint64 // Received from upstream servers for the Client.
+	ConnectAttempts   uint64 // Connects from the Client.
+	ConnectFailures   uint64 // Connects refused, or to servers that couldn't be reached.
+
+	State   int // Link state now: TransportNotReady, Disconnected or Connected.
+	Streams int // Streams open or opening on the link now.
+}
+
+func (g *Gateway) Stats() GatewayStats {
+	st := &g.stats
+	stats := GatewayStats{
+		FramesSent:        st.framesSent.Load(),
+		FramesReceived:    st.framesReceived.Load(),
+		IntegrityFailures: st.integrityFailures.Load(),
+		RxTimeouts:        st.rxTimeouts.Load(),
+		Retransmits:       st.retransmits.Load(),
+		RetriesExhausted:  st.retriesExhausted.Load(),
+		BytesUp:           st.bytesUp.Load(),
+		BytesDown:         st.bytesDown.Load(),
+		ConnectAttempts:   st.connectAttempts.Load(),
+		ConnectFailures:   st.connectFailures.Load(),
+	}
+	// Under the lock updateState holds, as the metrics endpoint reads this from its own goroutines.
+	g.streamsLock.Lock()
+	stats.State = int(g.state.Load())
+	stats.Streams = len(g.streams)
+	g.streamsLock.Unlock()
+	return stats
+}
@@ -0,0 +1,142 @@
+package protocol
+
+import (
+	"crypto/cipher"
+	"sync/atomic"
+)
+
+// A single connection carried over a protocol link, with its own sequence state.
+// Stream 0 is the only stream legacy partners know about.
+// Other streams can be used once multiplexing has been negotiated.
+type stream struct {
+	link              *protocolTransport
+	channel           byte
+	state             atomic.Uint32
+	acknowledgeEvent  chan byte
+	expectedRxSeqFlag bool
+	window            int  // Negotiated sliding window size. 0 or 1 means legacy stop-and-wait.
+	expectedRxSeq     byte // Next in-order sequence number when using a sliding window.
+	datagram          bool // UDP stream. Publish packets carry datagrams instead of a byte stream.
+	rxFragments       []byte
+	rxOversized       bool // Datagram being received is too large, and will be dropped.
+
+	txCipher, rxCipher cipher.AEAD // Nil unless the stream is encrypted.
+	txSealed, rxOpened uint64      // Publish payloads sealed and opened so far. Used as GCM nonces.
+
+	deflater *deflater // Nil unless the stream is compressed.
+	inflater *inflater
+}
+
+// Set up a new stream on channel of link. In place, as the state must not be copied.
+func (s *stream) init(link *protocolTransport, channel byte) {
+	s.link = link
+	s.channel = channel
+	s.state.Store(Disconnected)
+	s.acknowledgeEvent = make(chan byte, 4)
+}
+
+// Queue packet for TX on this stream's channel.
+func (s *stream) send(p Packet) {
+	p.channel = s.channel
+	s.link.send(p)
+}
+
+// Acknowledge a publish packet received from the protocol partner.
+// Returns the payload if it is new, in-order data, or false if it is a duplicate to be discarded.
+func (s *stream) acceptPublish(p *Packet) ([]byte, bool) {
+	if s.window > 1 {
+		if len(p.payload) == 0 {
+			return nil, false
+		}
+		rxSeq := p.payload[0]
+		if rxSeq != s.expectedRxSeq {
+			// Out of order or repeated. Re-acknowledge the last packet we accepted.
+			s.send(Packet{command: acknowledge, payload: []byte{s.expectedRxSeq - 1}})
+			return nil, false
+		}
+		s.expectedRxSeq++
+		s.send(Packet{command: acknowledge, payload: []byte{rxSeq}})
+		return p.payload[1:], true
+	}
+
+	var rxSeqFlag bool = (p.command & 0x80) > 0
+	s.send(Packet{command: acknowledge | (p.command & 0x80)})
+	if rxSeqFlag != s.expectedRxSeqFlag {
+		return nil, false
+	}
+	s.expectedRxSeqFlag = !s.expectedRxSeqFlag
+	return p.payload, true
+}
+
+// Decode the sequence number or flag carried by an acknowledge packet.
+func (s *stream) ackSequence(p *Packet) (byte, bool) {
+	if s.window > 1 {
+		if len(p.payload) != 1 {
+			return 0, false
+		}
+		return p.payload[0], true
+	}
+	return p.command >> 7, true
+}
+
+// Pass an acknowledge packet on to the stream's packetSender.
+// If the sender is not keeping up the ack is dropped rather than stall the other streams on the link.
+// The sender then retransmits, and gets acknowledged again.
+func (s *stream) handleAck(p *Packet) {
+	if s.state.Load() != Connected {
+		return
+	}
+	if rxSeq, ok := s.ackSequence(p); ok {
+		select {
+		case s.acknowledgeEvent <- rxSeq:
+		default:
+		}
+	}
+}
+
+// Largest publish payload that fits in a single packet on this stream.
+func (s *stream) maxPayload() int {
+	n := s.link.checkFor(publish).maxPayload()
+	if s.window > 1 {
+		n-- // sequence number
+	}
+	if s.channel != 0 {
+		n-- // channel number
+	}
+	if s.txCipher != nil {
+		n -= s.txCipher.Overhead() // authentication tag
+	}
+	return n
+}
+
+// Largest datagram carried on a UDP stream.
+const maxDatagramSize = 65507
+
+// Split a datagram into publish packets that fit on the stream.
+// All but the last are flagged, so the receiver knows where the datagram ends.
+func (s *stream) fragmentDatagram(d []byte) []Packet {
+	max := s.maxPayload()
+	fragments := make([]Packet, 0, len(d)/max+1)
+	for len(d) > max {
+		fragments = append(fragments, Packet{command: publish | moreFlag, payload: d[:max]})
+		d = d[max:]
+	}
+	return append(fragments, Packet{command: publish, payload: d})
+}
+
+// Collect a publish payload on a UDP stream. Returns the whole datagram once its last fragment arrives.
+func (s *stream) reassembleDatagram(p *Packet, payload []byte) ([]byte, bool) {
+	if !s.rxOversized {
+		s.rxFragments = append(s.rxFragments, payload...)
+		if len(s.rxFragments) > maxDatagramSize {
+			s.rxFragments = nil
+			s.rxOversized = true
+		}
+	}
+	if p.command&moreFlag != 0 {
+		return nil, false
+	}
+	d, dropped := s.rxFragments, s.rxOversized
+	s.rxFragments, s.rxOversized = nil, false
+	return d, !dropped
+}
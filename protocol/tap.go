@@ -0,0 +1,162 @@
+package protocol
+
+import (
+	"context"
+	"sync"
+)
+
+// Sits in the middle of a serial link between a Client and a Gateway, without taking part in it.
+// Bytes are relayed between the two ports as they arrive, and what passes in each direction is decoded
+// with the same framing and integrity checking the ends use, and logged as it happens.
+type Tap struct {
+	// Names of the ports in log messages, like the serial ports. Default "A" and "B".
+	NameA, NameB string
+
+	// Framing of the link.
+	Framing Framing
+
+	// Integrity check of packets other than hello when the Tap starts.
+	// The Tap switches to the one a hello packet asks for or grants, unless FixedIntegrity is set.
+	Integrity      Integrity
+	FixedIntegrity bool
+
+	// Where decoded packets are logged to, at info level, with their direction like "A->B" as the message.
+	// Bytes that don't make a packet are logged at warn level. Nil means the standard log package.
+	Logger Logger
+
+	// ByteTimeout as the ends use, and bytes of each direction waiting to be decoded (RxBufferSize,
+	// 4096 if zero). Other Timings are not used by the Tap.
+	Timings Timings
+}
+
+// One direction of the link.
+type tapDirection struct {
+	protocolTransport
+	name string
+}
+
+// Relay between a and b until ctx is done or either fails, decoding both directions.
+// Both ports are closed before returning. Returns ctx.Err(), or the error a port failed with.
+func (tp *Tap) Serve(ctx context.Context, a, b serialInterface) error {
+	if err := tp.Timings.Validate(); err != nil {
+		a.Close()
+		b.Close()
+		return err
+	}
+	nameA, nameB := tp.NameA, tp.NameB
+	if nameA == "" {
+		nameA = "A"
+	}
+	if nameB == "" {
+		nameB = "B"
+	}
+	logger := newLinkLogger(tp.Logger, false)
+	closed := make(chan struct{})
+	windows := new(streamWindows) // connects and connacks pass in opposite directions
+	directions := [2]*tapDirection{
+		tp.newDirection(nameA+"->"+nameB, logger, closed, windows),
+		tp.newDirection(nameB+"->"+nameA, logger, closed, windows),
+	}
+
+	var failOnce sync.Once
+	var err error
+	fail := func(e error) {
+		failOnce.Do(func() {
+			err = e
+			close(closed)
+			a.Close()
+			b.Close()
+		})
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			fail(ctx.Err())
+		case <-closed:
+		}
+	}()
+
+	// Not waited for, as Read may not return before a port is closed, or at all.
+	go directions[0].relay(a, b, fail)
+	go directions[1].relay(b, a, fail)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); directions[0].decode(directions[:], tp.FixedIntegrity) }()
+	go func() { defer wg.Done(); directions[1].decode(directions[:], tp.FixedIntegrity) }()
+	wg.Wait()
+	return err
+}
+
+func (tp *Tap) newDirection(name string, logger linkLogger, closed chan struct{}, windows *streamWindows) *tapDirection {
+	d := &tapDirection{name: name}
+	d.timings = tp.Timings
+	if d.timings.RxBufferSize == 0 {
+		d.timings.RxBufferSize = 4096
+	}
+	d.timings = d.timings.WithDefaults()
+	d.rxBuff = make(chan byte, d.timings.RxBufferSize)
+	d.closed = closed
+	d.framing = tp.Framing
+	d.setIntegrity(tp.Integrity)
+	d.logger = logger
+	d.windows = windows
+	return d
+}
+
+// Copy bytes from src to dst as they arrive, and pass them on to be decoded.
+// If decoding falls behind, bytes are relayed but not decoded, so the link is never held up.
+func (d *tapDirection) relay(src, dst serialInterface, fail func(error)) {
+	buf := make([]byte, 512)
+	dropped := false
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			fail(err)
+			return
+		}
+		if _, err = dst.Write(buf[:n]); err != nil {
+			fail(err)
+			return
+		}
+		for _, b := range buf[:n] {
+			select {
+			case d.rxBuff <- b:
+				dropped = false
+			default:
+				if !dropped {
+					d.logger.warn("Decoding fell behind. Bytes relayed but not decoded", "direction", d.name)
+					dropped = true
+				}
+			}
+		}
+	}
+}
+
+// Log every packet passing in this direction, and the bytes that don't make one.
+// A hello sets the integrity check of both directions, as the Gateway's answer is the last word.
+func (d *tapDirection) decode(directions []*tapDirection, fixedIntegrity bool) {
+	for {
+		p, received, result := d.readPacket(d.rxByte)
+		switch result {
+		case rxClosed:
+			return
+		case rxPacket:
+			windowed := p.decodeChannel() && d.windows.observe(&p)
+			d.logger.info(d.name, packetAttrs(&p, d.checkFor(p.command), true, windowed)...)
+			if !fixedIntegrity && p.command&commandMask == hello {
+				if _, _, check, ok := parseHello(&p); ok && check.valid() {
+					for _, dir := range directions {
+						dir.setIntegrity(check)
+					}
+				}
+			}
+		default:
+			reason := "CRCFAIL"
+			if result == rxTimedOut {
+				reason = "timeout"
+			}
+			d.logger.warn(d.name, "garbage", len(received), "result", reason)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package protocol
+
+import (
+	"errors"
+	"time"
+)
+
+// Timings and buffer sizes of a serial link.
+// The defaults suit most links. Slow ones, like 9600 baud radio modems, need longer timeouts,
+// and fast ones, like USB CDC at 1 Mbaud, can do with shorter timeouts and need larger buffers.
+// Zero fields take the defaults.
+type Timings struct {
+	// Longest to wait for the next byte of a packet that has started arriving, before dropping it.
+	// Zero means DefaultByteTimeout.
+	ByteTimeout time.Duration
+
+	// Bad or stalled packets in a row before a connected link is dropped. Zero means DefaultMaxRxErrors.
+	MaxRxErrors int
+
+	// Longest to wait for a publish packet to be acknowledged, before sending it again.
+	// Zero means DefaultAckTimeout.
+	AckTimeout time.Duration
+
+	// Times a publish packet is sent again without an acknowledgement, before its connection is dropped.
+	// Zero means DefaultMaxRetries.
+	MaxRetries int
+
+	// Longest a Gateway waits for the Client to accept an inbound connection. Zero means DefaultConnackTimeout.
+	// A Client waits for the Gateway's answer to a connect for Dialer.Timeout.
+	ConnackTimeout time.Duration
+
+	// Bytes received but not yet parsed. Zero means DefaultRxBufferSize.
+	RxBufferSize int
+
+	// Packets queued for sending. Zero means DefaultTxQueueSize.
+	TxQueueSize int
+
+	// How often to try opening a serial port that fails to open, when serving one like comwrapper does.
+	// Zero means DefaultOpenRetry.
+	OpenRetry time.Duration
+
+	// How long to leave a serial port closed after the link on it failed, before opening it again.
+	// Zero means DefaultRestartDelay.
+	RestartDelay time.Duration
+}
+
+// Defaults of Timings.
+const (
+	DefaultByteTimeout    = time.Millisecond * 100
+	DefaultMaxRxErrors    = 5
+	DefaultAckTimeout     = time.Millisecond * 500
+	DefaultMaxRetries     = 5
+	DefaultConnackTimeout = time.Second * 5
+	DefaultRxBufferSize   = 512
+	DefaultTxQueueSize    = 2
+	DefaultOpenRetry      = time.Second * 5
+	DefaultRestartDelay   = time.Second * 2
+)
+
+// Check that no timing or size is negative.
+func (t *Timings) Validate() error {
+	if t.ByteTimeout < 0 || t.AckTimeout < 0 || t.ConnackTimeout < 0 || t.OpenRetry < 0 || t.RestartDelay < 0 {
+		return errors.New("Invalid timings. Timeouts must not be negative")
+	}
+	if t.MaxRxErrors < 0 || t.MaxRetries < 0 {
+		return errors.New("Invalid timings. Error limits must not be negative")
+	}
+	if t.RxBufferSize < 0 || t.TxQueueSize < 0 {
+		return errors.New("Invalid timings. Buffer sizes must not be negative")
+	}
+	return nil
+}
+
+// Timings with the defaults filled in, for serving a link the way comwrapper does.
+func (t Timings) WithDefaults() Timings {
+	if t.ByteTimeout == 0 {
+		t.ByteTimeout = DefaultByteTimeout
+	}
+	if t.MaxRxErrors == 0 {
+		t.MaxRxErrors = DefaultMaxRxErrors
+	}
+	if t.AckTimeout == 0 {
+		t.AckTimeout = DefaultAckTimeout
+	}
+	if t.MaxRetries == 0 {
+		t.MaxRetries = DefaultMaxRetries
+	}
+	if t.ConnackTimeout == 0 {
+		t.ConnackTimeout = DefaultConnackTimeout
+	}
+	if t.RxBufferSize == 0 {
+		t.RxBufferSize = DefaultRxBufferSize
+	}
+	if t.TxQueueSize == 0 {
+		t.TxQueueSize = DefaultTxQueueSize
+	}
+	if t.OpenRetry == 0 {
+		t.OpenRetry = DefaultOpenRetry
+	}
+	if t.RestartDelay == 0 {
+		t.RestartDelay = DefaultRestartDelay
+	}
+	return t
+}
@@ -1,13 +1,11 @@
 package protocol
 
 import (
-	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Used for debug logging
-var logLock sync.RWMutex
-
 // Serial connection over which protocol runs.
 // Represents simple 2-way noisy wire.
 // Typically, a RS-232 Port or UART would implement this interface.
@@ -26,70 +24,227 @@ const (
 )
 
 // Transport/Session control between two Protocol entities.
+// The link is shared by all streams multiplexed over it.
 type protocolTransport struct {
-	state             uint8
-	session           sync.WaitGroup
-	com               serialInterface
-	rxBuff            chan byte
-	txBuff            chan Packet
-	acknowledgeEvent  chan bool
-	expectedRxSeqFlag bool
+	state     atomic.Uint32 // Connected while at least one stream is connected.
+	session   sync.WaitGroup
+	com       serialInterface
+	rxBuff    chan byte
+	txBuff    chan Packet
+	closed    chan struct{} // Closed when the link is released.
+	closeOnce *sync.Once
+	framing   Framing
+	integrity atomic.Uint32 // Integrity check of packets other than hello.
+	logger    linkLogger
+	capture   *Capture       // Records what crosses com, if set.
+	windows   *streamWindows // Of the streams, for decoding what is traced and captured.
+	timings   Timings        // With the defaults filled in.
+
+	rxActivity       atomic.Bool // Set by every valid packet received.
+	keepAliveRunning atomic.Bool
+
+	stats linkStats
+}
+
+// Prepare buffers for a new link over com.
+func (t *protocolTransport) init(com serialInterface, timings Timings) {
+	t.com = com
+	t.timings = timings.WithDefaults()
+	t.rxBuff = make(chan byte, t.timings.RxBufferSize)
+	t.txBuff = make(chan Packet, t.timings.TxQueueSize)
+	t.closed = make(chan struct{})
+	t.closeOnce = new(sync.Once)
+	t.windows = new(streamWindows)
+	t.state.Store(Disconnected)
+	t.setIntegrity(IntegrityCRC32)
+}
+
+// Whether p belongs to a stream with a sliding window, as far as the packets traced so far tell.
+// Only followed while tracing or capturing, as nothing else needs it.
+func (t *protocolTransport) windowed(p *Packet) bool {
+	if !t.logger.trace && t.capture == nil {
+		return false
+	}
+	return t.windows.observe(p)
+}
+
+// Set the link Connected or Disconnected, unless it has been released.
+func (t *protocolTransport) setConnected(connected bool) {
+	state := uint32(Disconnected)
+	if connected {
+		state = Connected
+	}
+	for {
+		old := t.state.Load()
+		if old == TransportNotReady || t.state.CompareAndSwap(old, state) {
+			return
+		}
+	}
+}
+
+// Release the link. Goroutines serving it return, and further packets are discarded.
+func (t *protocolTransport) close() {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		t.com.Close()
+		t.state.Store(TransportNotReady)
+	})
+}
+
+// Queue packet for TX. Dropped if the link has been released.
+func (t *protocolTransport) send(p Packet) {
+	select {
+	case t.txBuff <- p:
+	case <-t.closed:
+	}
+}
+
+// Wait until the packets queued so far have been written out, for up to timeout.
+func (t *protocolTransport) flush(timeout time.Duration) {
+	flushed := make(chan struct{})
+	select {
+	case t.txBuff <- Packet{flushed: flushed}:
+	case <-t.closed:
+		return
+	}
+	select {
+	case <-flushed:
+	case <-time.After(timeout):
+	case <-t.closed:
+	}
+}
+
+// Default number of keepalive intervals in a row without hearing from the protocol partner
+// before the link is dropped.
+const DefaultKeepAliveMisses = 3
+
+// Ping the protocol partner every interval in which nothing was received from it.
+// After more than misses intervals in a row without an answer, onDead is called and keepalive stops.
+// Does nothing if keepalive is already running on the link.
+func (t *protocolTransport) startKeepAlive(interval time.Duration, misses int, onDead func()) {
+	if interval <= 0 || !t.keepAliveRunning.CompareAndSwap(false, true) {
+		return
+	}
+	if misses <= 0 {
+		misses = DefaultKeepAliveMisses
+	}
+	t.rxActivity.Store(true)
+
+	go func() {
+		defer t.keepAliveRunning.Store(false)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		missed := 0
+		for {
+			select {
+			case <-ticker.C:
+			case <-t.closed:
+				return
+			}
+			if t.rxActivity.Swap(false) {
+				missed = 0
+				continue
+			}
+			missed++
+			if missed > misses {
+				t.logger.warn("No answer to keepalive pings. Dropping link", "pings", misses)
+				onDead()
+				return
+			}
+			t.send(Packet{command: ping})
+		}
+	}()
+}
+
+// Get next byte from RX buffer. Waits forever if timeout is 0.
+// ok is false if the link was released or the timeout expired.
+func (t *protocolTransport) rxByte(timeout time.Duration) (b byte, ok bool, timedOut bool) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	select {
+	case b = <-t.rxBuff:
+		return b, true, false
+	case <-expired:
+		return 0, false, true
+	case <-t.closed:
+		return 0, false, false
+	}
 }
 
 // Receive from serial wire and write to buffer.
-func (t *protocolTransport) rxSerial(onReadFail func()) {
-	defer t.session.Done()
+// Not part of the session, as Read may not return before com is closed. The link may be set up
+// again on another com meanwhile, so this sticks to the one it started with.
+func (t *protocolTransport) rxSerial(onReadFail func(error)) {
+	com, rxBuff, closed, capture := t.com, t.rxBuff, t.closed, t.capture
 	rx := make([]byte, 512)
-	t.com.Flush()
+	com.Flush()
 	for {
-		nRx, err := t.com.Read(rx)
+		nRx, err := com.Read(rx)
 		if err != nil {
-			log.Printf("Error receiving on COM: %v\n", err)
+			select {
+			case <-closed:
+				return // released already
+			default:
+			}
+			t.logger.error("Error receiving on COM", "error", err)
 			if onReadFail != nil {
-				onReadFail()
+				onReadFail(err)
 			}
 			return
 		}
-		/*
-			// For debugging
-			logLock.Lock()
-			log.Println("serial RX:")
-			log.Println(rx[:nRx])
-			log.Println(string(rx[:nRx]))
-			logLock.Unlock()
-		*/
+		t.captureBytes(capture, captureRX, rx[:nRx])
 		for _, v := range rx[:nRx] {
-			t.rxBuff <- v
+			select {
+			case rxBuff <- v:
+			case <-closed:
+				return
+			}
 		}
 	}
 }
 
 // Read from TX buffer and write out downstream.
-func (t *protocolTransport) txSerial(onWriteFail func()) {
+func (t *protocolTransport) txSerial(onWriteFail func(error)) {
 	defer t.session.Done()
-	for txPacket := range t.txBuff {
-		txPacket.length = byte(len(txPacket.payload) + 5)
-		txPacket.crc = txPacket.calcCrc()
-		serialPacket := txPacket.serialize()
+	for {
+		var txPacket Packet
+		select {
+		case txPacket = <-t.txBuff:
+		case <-t.closed:
+			return
+		}
+		if txPacket.flushed != nil {
+			close(txPacket.flushed)
+			continue
+		}
+		traced := txPacket // as the stream sent it, without the channel number
+		txPacket.encodeChannel()
+		check := t.checkFor(txPacket.command)
+		txPacket.length = byte(len(txPacket.payload) + 1 + check.size())
+		ser := check.appendCheck(txPacket.serialize())
+		serialPacket := ser
+		if t.framing == FramingCOBS {
+			serialPacket = cobsFrame(ser)
+		}
 
 		nTx, err := t.com.Write(serialPacket)
 		if err != nil {
-			log.Printf("Error writing to COM: %v\n", err)
+			t.logger.error("Error writing to COM", "error", err)
 			if onWriteFail != nil {
-				onWriteFail()
+				onWriteFail(err)
 			}
 			return
 		}
-		/*
-			// For debugging
-			logLock.Lock()
-			log.Println("serial TX:")
-			log.Println(serialPacket)
-			log.Println(string(serialPacket[2:]))
-			logLock.Unlock()
-		*/
+		t.stats.framesSent.Add(1)
+		traced.length = txPacket.length
+		windowed := t.windowed(&traced)
+		t.logger.tracePacket("TX", &traced, check, true, windowed)
+		t.captureBytes(t.capture, captureTX, serialPacket[:nTx])
+		t.capturePacket(captureTX, ser, &traced, check, true, windowed)
 		if nTx != len(serialPacket) {
-			log.Printf("TX mismatch. Want to send %v bytes. Sent: %v bytes.", len(serialPacket), nTx)
+			t.logger.warn("TX mismatch", "want", len(serialPacket), "sent", nTx)
 		}
 	}
 }